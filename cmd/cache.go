@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"gitr-backup/sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Manage the local mirror cache",
+}
+
+var cacheGcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Remove unused mirrors from the cache",
+	Long: `Remove the cached mirrors which have not been used for longer than
+cache.max_age, then the least recently used ones until the cache is smaller
+than cache.max_size_mb. Mirrors in use by a running backup are skipped.`,
+	Run: runCacheGc,
+}
+
+var cacheMaxAge time.Duration
+
+func runCacheGc(cmd *cobra.Command, args []string) {
+	ctx, config := setup()
+
+	if cmd.Flags().Changed("max-age") {
+		config.Cache.MaxAge = cacheMaxAge
+	}
+
+	err := sync.GarbageCollectCache(ctx, config.Cache)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+func init() {
+	cacheGcCmd.Flags().DurationVar(&cacheMaxAge, "max-age", 0, "Override the maximum age of cached mirrors")
+
+	cacheCmd.AddCommand(cacheGcCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
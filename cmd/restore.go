@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"gitr-backup/sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore --from <backup-host> --to <host> [repos...]",
+	Short: "Restore backup repositories to a host",
+	Long: `Recreate the repositories of a backup host on another host, pushing all
+their refs and restoring their default branch and description. Only
+repositories whose description marks them as backups are restored.`,
+	Run: runRestore,
+}
+
+var restoreFrom string
+var restoreTo string
+
+func runRestore(cmd *cobra.Command, args []string) {
+	ctx, config := setup()
+
+	err := sync.RestoreHost(ctx, config, restoreFrom, restoreTo, args)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreFrom, "from", "", "Name of the backup host to restore from")
+	restoreCmd.Flags().StringVar(&restoreTo, "to", "", "Name of the host to restore to")
+	_ = restoreCmd.MarkFlagRequired("from")
+	_ = restoreCmd.MarkFlagRequired("to")
+
+	rootCmd.AddCommand(restoreCmd)
+}
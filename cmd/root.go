@@ -6,6 +6,10 @@ package cmd
 import (
 	"context"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -13,6 +17,7 @@ import (
 
 	"gitr-backup/config"
 	"gitr-backup/constants"
+	"gitr-backup/metrics"
 	"gitr-backup/sync"
 
 	"github.com/spf13/cobra"
@@ -26,10 +31,14 @@ var rootCmd = &cobra.Command{
 }
 
 var dryRun bool
+var forceDestructive bool
 var debugMode bool
+var reportPath string
+var reportFormat string
+var metricsTextfile string
 
-func run(cmd *cobra.Command, args []string) {
-	ctx := context.WithValue(context.Background(), constants.DRY_RUN, dryRun)
+// Set up logging and load the configuration file, for all commands
+func setup() (context.Context, *config.Config) {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
 	if !debugMode {
 		log.Logger = log.Logger.Level(zerolog.InfoLevel)
@@ -40,7 +49,67 @@ func run(cmd *cobra.Command, args []string) {
 		log.Fatal().Err(err).Send()
 	}
 
-	err = sync.SyncHosts(ctx, config, args)
+	// The first signal stops scheduling new work, the second one kills the
+	// process as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Warn().Msg("Interrupted, waiting for running operations to finish. Interrupt again to abort.")
+	}()
+
+	ctx = context.WithValue(ctx, constants.DRY_RUN, dryRun)
+	ctx = context.WithValue(ctx, constants.FORCE_DESTRUCTIVE, forceDestructive)
+	ctx = context.WithValue(ctx, constants.CACHE_DIR, config.Cache.Path)
+
+	return ctx, config
+}
+
+func checkReportFormat() {
+	if !slices.Contains(sync.ReportFormats, reportFormat) {
+		log.Fatal().Msgf("invalid report format: %s (expected one of %s)", reportFormat, strings.Join(sync.ReportFormats, ", "))
+	}
+}
+
+// Write the report and metrics files requested on the command line, also
+// when some repositories failed
+func writeOutputs(report *sync.Report, err error) {
+	if reportPath != "" {
+		reportErr := report.Write(reportPath, reportFormat)
+		if reportErr != nil {
+			log.Error().Err(reportErr).Msg("Failed writing report")
+		}
+	}
+
+	writeMetrics(report, err)
+}
+
+// Only update the metrics, e.g. after a run which doesn't cover all the
+// repositories and would overwrite the report with a partial one
+func writeMetrics(report *sync.Report, err error) {
+	if metricsTextfile != "" {
+		metricsErr := metrics.WriteTextfile(metricsTextfile)
+		if metricsErr != nil {
+			log.Error().Err(metricsErr).Msg("Failed writing metrics")
+		}
+	}
+}
+
+// Flags shared by the commands running synchronizations
+func addOutputFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&reportPath, "report", "", "Write a report of the synchronization to this file")
+	cmd.Flags().StringVar(&reportFormat, "report-format", "json", "Format of the report (json, junit or markdown)")
+	cmd.Flags().StringVar(&metricsTextfile, "metrics-textfile", "", "Write metrics to this file for the node_exporter textfile collector")
+}
+
+func run(cmd *cobra.Command, args []string) {
+	checkReportFormat()
+
+	ctx, config := setup()
+
+	report, err := sync.SyncHosts(ctx, config, args)
+	writeOutputs(report, err)
+
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
@@ -55,5 +124,8 @@ func Execute() {
 
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&dryRun, "dry-run", "n", false, "Dry-run mode")
+	// Only for one-shot runs, the daemon would never check the thresholds again
+	rootCmd.Flags().BoolVar(&forceDestructive, "force-destructive", false, "Apply the changes beyond the safety thresholds")
 	rootCmd.PersistentFlags().BoolVarP(&debugMode, "debug", "D", false, "Debug mode")
+	addOutputFlags(rootCmd)
 }
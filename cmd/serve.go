@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"gitr-backup/daemon"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run the synchronization on a schedule",
+	Long: `Run the synchronization on the schedule set in the daemon section of the
+configuration file, never starting a run while the previous one is still in
+progress. Health, readiness, status, metrics and manual trigger endpoints are
+served over HTTP.`,
+	Run: runServe,
+}
+
+func runServe(cmd *cobra.Command, args []string) {
+	checkReportFormat()
+
+	ctx, config := setup()
+
+	err := daemon.New(ctx, config, writeOutputs, writeMetrics).Serve()
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+func init() {
+	addOutputFlags(serveCmd)
+
+	rootCmd.AddCommand(serveCmd)
+}
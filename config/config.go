@@ -4,36 +4,344 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/robfig/cron/v3"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
-	//"gopkg.in/yaml.v3"
 )
 
 type Config struct {
 	Hosts []Host `yaml:"hosts"`
+	Cache Cache  `yaml:"cache"`
+	// Defaults for all hosts, and the number of repositories processed in
+	// parallel
+	Concurrency Concurrency `yaml:"concurrency"`
+	// Settings of the serve command
+	Daemon Daemon `yaml:"daemon"`
+	// Thresholds beyond which changes losing data are refused
+	Safety Safety `yaml:"safety"`
+	// Refs to synchronize, for the hosts which don't override them
+	Refs RefPatterns `yaml:"refs"`
+}
+
+// Patterns of the refs to synchronize, where * matches any sequence of
+// characters, slashes included. Exclusions win over inclusions.
+type RefPatterns struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+func matchRefPattern(pattern, refName string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == refName
+	}
+
+	rest, found := strings.CutPrefix(refName, parts[0])
+	if !found {
+		return false
+	}
+
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+
+		rest = rest[i+len(part):]
+	}
+
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
+
+func (patterns *RefPatterns) Match(refName string) bool {
+	for _, pattern := range patterns.Exclude {
+		if matchRefPattern(pattern, refName) {
+			return false
+		}
+	}
+
+	for _, pattern := range patterns.Include {
+		if matchRefPattern(pattern, refName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check whether only branches and tags can match, which the forge APIs can
+// list without going through the git protocol
+func (patterns *RefPatterns) OnlyBranchesAndTags() bool {
+	for _, pattern := range patterns.Include {
+		if !strings.HasPrefix(pattern, "refs/heads/") && !strings.HasPrefix(pattern, "refs/tags/") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Complete the patterns of a host with the global ones: the inclusions of the
+// host replace the global ones, but the exclusions add up
+func (patterns *RefPatterns) inherit(global RefPatterns) {
+	if len(patterns.Include) == 0 {
+		patterns.Include = global.Include
+	}
+
+	patterns.Exclude = slices.Concat(global.Exclude, patterns.Exclude)
+}
+
+func (patterns *RefPatterns) massageConfig() error {
+	for _, pattern := range slices.Concat(patterns.Include, patterns.Exclude) {
+		if !strings.HasPrefix(pattern, "refs/") {
+			return fmt.Errorf("invalid ref pattern: %s (must start with refs/)", pattern)
+		}
+	}
+
+	return nil
+}
+
+// Unset thresholds are not checked
+type Safety struct {
+	// Percentage of the refs of a backup deleted at once
+	MaxDeletedRefsPercent int `yaml:"max_deleted_refs_percent"`
+	// Branches rewritten or tags moved at once in a backup
+	MaxForceUpdates int `yaml:"max_force_updates"`
+	// Backups deleting or rewriting refs, or deleted, in a single run
+	MaxAffectedRepositories int `yaml:"max_affected_repositories"`
+}
+
+type Daemon struct {
+	// Cron expression, or interval between runs (e.g. 6h)
+	Schedule string `yaml:"schedule"`
+	// Maximum random delay before processing each destination
+	Jitter time.Duration `yaml:"jitter"`
+	Listen string        `yaml:"listen"`
+	// Bearer token required by the trigger endpoint, if set
+	TriggerToken string `yaml:"trigger_token"`
+}
+
+// Parse the schedule of the daemon, as a standard cron expression, a
+// descriptor such as @daily, or a plain interval
+func (daemon *Daemon) ParseSchedule() (cron.Schedule, error) {
+	if interval, err := time.ParseDuration(daemon.Schedule); err == nil {
+		if interval <= 0 {
+			return nil, errors.New("the schedule interval must be positive")
+		}
+
+		return cron.Every(interval), nil
+	}
+
+	return cron.ParseStandard(daemon.Schedule)
+}
+
+type Concurrency struct {
+	// Only used globally
+	Repositories int `yaml:"repositories"`
+	// Concurrent requests to the API of a host
+	Api int `yaml:"api"`
+	// Concurrent clones and pushes involving a host. The global value
+	// limits transfers across all hosts.
+	Transfers int `yaml:"transfers"`
+}
+
+// Local mirrors of the source repositories, kept across runs so only new
+// objects have to be fetched
+type Cache struct {
+	Path      string        `yaml:"path"`
+	MaxAge    time.Duration `yaml:"max_age"`
+	MaxSizeMB int64         `yaml:"max_size_mb"`
 }
 
 func (config *Config) massageConfig() error {
+	if config.Cache.Path != "" {
+		path, err := filepath.Abs(config.Cache.Path)
+		if err != nil {
+			return err
+		}
+
+		config.Cache.Path = path
+	}
+
+	if config.Cache.MaxAge < 0 || config.Cache.MaxSizeMB < 0 {
+		return errors.New("cache limits cannot be negative")
+	}
+
+	if config.Daemon.Listen == "" {
+		config.Daemon.Listen = ":8080"
+	}
+
+	if config.Daemon.Jitter < 0 {
+		return errors.New("the daemon jitter cannot be negative")
+	}
+
+	if config.Daemon.Schedule != "" {
+		_, err := config.Daemon.ParseSchedule()
+		if err != nil {
+			return fmt.Errorf("invalid daemon schedule: %w", err)
+		}
+	}
+
+	err := readEnvVar(log.Logger, &config.Daemon.TriggerToken)
+	if err != nil {
+		return err
+	}
+
+	if len(config.Refs.Include) == 0 {
+		config.Refs.Include = []string{"refs/heads/*", "refs/tags/*"}
+	}
+
+	err = config.Refs.massageConfig()
+	if err != nil {
+		return err
+	}
+
+	safety := &config.Safety
+	if safety.MaxDeletedRefsPercent < 0 || safety.MaxForceUpdates < 0 || safety.MaxAffectedRepositories < 0 {
+		return errors.New("safety thresholds cannot be negative")
+	}
+
+	if safety.MaxDeletedRefsPercent > 100 {
+		return errors.New("the maximum percentage of deleted refs cannot exceed 100")
+	}
+
+	concurrency := &config.Concurrency
+	if concurrency.Repositories < 0 || concurrency.Api < 0 || concurrency.Transfers < 0 {
+		return errors.New("concurrency limits cannot be negative")
+	}
+
+	if concurrency.Repositories == 0 {
+		concurrency.Repositories = 4
+	}
+
+	if concurrency.Api == 0 {
+		concurrency.Api = 4
+	}
+
+	if concurrency.Transfers == 0 {
+		concurrency.Transfers = concurrency.Repositories
+	}
+
 	for i := range config.Hosts {
-		err := (&config.Hosts[i]).massageConfig(i)
+		host := &config.Hosts[i]
+		err := host.massageConfig(i)
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed to parse host %d config", i)
 			return err
 		}
+
+		if host.Concurrency.Repositories != 0 {
+			return fmt.Errorf("host %s: the number of parallel repositories can only be set globally", host.Name)
+		}
+
+		if host.Concurrency.Api < 0 || host.Concurrency.Transfers < 0 {
+			return fmt.Errorf("host %s: concurrency limits cannot be negative", host.Name)
+		}
+
+		if host.Concurrency.Api == 0 {
+			host.Concurrency.Api = concurrency.Api
+		}
+
+		// Transfers per host are only limited by the global limit by default
+		if host.Concurrency.Transfers == 0 {
+			host.Concurrency.Transfers = concurrency.Transfers
+		}
+
+		host.Refs.inherit(config.Refs)
 	}
 
 	return nil
 }
 
 type Host struct {
-	Name    string `yaml:"name"`
-	Type    string `yaml:"type"`
-	BaseUrl string `yaml:"base"`
-	Token   string `yaml:"token"`
-	Usage   string `yaml:"use_as"`
+	Name        string      `yaml:"name"`
+	Type        string      `yaml:"type"`
+	BaseUrl     string      `yaml:"base"`
+	Token       string      `yaml:"token"`
+	Usage       string      `yaml:"use_as"`
+	Owners      []string    `yaml:"owners"`
+	Options     yaml.Node   `yaml:"options"`
+	Concurrency Concurrency `yaml:"concurrency"`
+	// Secret of the push webhooks received from this host
+	WebhookSecret string `yaml:"webhook_secret"`
+	// What to do with backups whose source is gone, on a backup host
+	Orphans Orphans `yaml:"orphans"`
+	// Keep the refs deleted or rewritten on the source, on a backup host
+	Protection Protection `yaml:"protection"`
+	// Refs to synchronize from this host
+	Refs RefPatterns `yaml:"refs"`
+	// How branches and tags are listed: api (default) or git
+	RefListing string `yaml:"ref_listing"`
+	// Copy the LFS objects of the repositories, on a backup host
+	Lfs Lfs `yaml:"lfs"`
+	// Back up the wikis of the repositories, on a source host
+	Wikis bool `yaml:"wikis"`
+}
+
+type Orphans struct {
+	// keep, archive, rename or delete
+	Policy string `yaml:"policy"`
+	// Time during which a repository must stay orphaned before the policy is
+	// applied
+	GracePeriod time.Duration `yaml:"grace_period"`
+	// Appended to the name of renamed repositories
+	Suffix string `yaml:"suffix"`
+}
+
+func (orphans *Orphans) massageConfig() error {
+	switch orphans.Policy {
+	case "":
+		orphans.Policy = "keep"
+	case "keep", "archive", "rename":
+	case "delete":
+		if orphans.GracePeriod == 0 {
+			return errors.New("a grace period is required to delete orphaned repositories")
+		}
+	default:
+		return fmt.Errorf("invalid orphan policy: %s (expected one of keep, archive, rename, delete)", orphans.Policy)
+	}
+
+	if orphans.GracePeriod < 0 {
+		return errors.New("the orphan grace period cannot be negative")
+	}
+
+	if orphans.Suffix == "" {
+		orphans.Suffix = "-orphaned"
+	}
+
+	return nil
+}
+
+// Refs deleted or force-pushed on the source are preserved under
+// refs/gitr-backup/deleted/<timestamp>/ before being updated
+type Protection struct {
+	Enabled bool `yaml:"enabled"`
+	// Preserved refs older than this are deleted, if set
+	MaxAge time.Duration `yaml:"max_age"`
+	// Number of timestamps kept per repository, if set
+	MaxSnapshots int `yaml:"max_snapshots"`
+}
+
+func (protection *Protection) massageConfig() error {
+	if protection.MaxAge < 0 || protection.MaxSnapshots < 0 {
+		return errors.New("ref protection retention cannot be negative")
+	}
+
+	return nil
+}
+
+type Lfs struct {
+	Enabled bool `yaml:"enabled"`
+	// Larger objects are skipped, if set
+	MaxObjectSizeMB int64 `yaml:"max_object_size_mb"`
+	// Objects copied to a repository in a single run, if set
+	MaxTotalSizeMB int64 `yaml:"max_total_size_mb"`
 }
 
 func readEnvVar(logger zerolog.Logger, val *string) error {
@@ -58,18 +366,9 @@ func (host *Host) massageConfig(i int) error {
 		return fmt.Errorf("missing host type: %s", host.Type)
 	}
 
-	if host.Type != "github" && host.Type != "gitea" {
-		return fmt.Errorf("invalid host type: %s", host.Type)
-	}
-
-	if host.Type == "github" {
-		if host.BaseUrl == "" {
-			host.BaseUrl = "https://github.com"
-		}
-	} else if host.Type == "gitea" {
-		if host.BaseUrl == "" {
-			return errors.New("a base url is required for a gitea host")
-		}
+	validator, found := validators[host.Type]
+	if !found {
+		return fmt.Errorf("invalid host type: %s (expected one of %s)", host.Type, registeredHostTypes())
 	}
 
 	if host.Name == "" {
@@ -77,8 +376,14 @@ func (host *Host) massageConfig(i int) error {
 		host.Name = host.Type
 	}
 
-	if host.Token == "" {
-		return errors.New("missing token for authentication")
+	if host.Usage == "backup" && len(host.Owners) > 1 {
+		return errors.New("a backup host can only have one owner")
+	}
+
+	for _, owner := range host.Owners {
+		if owner == "" {
+			return errors.New("empty owner name")
+		}
 	}
 
 	err := readEnvVar(logger, &host.Token)
@@ -91,6 +396,42 @@ func (host *Host) massageConfig(i int) error {
 		return err
 	}
 
+	err = readEnvVar(logger, &host.WebhookSecret)
+	if err != nil {
+		return err
+	}
+
+	err = host.Orphans.massageConfig()
+	if err != nil {
+		return err
+	}
+
+	err = host.Protection.massageConfig()
+	if err != nil {
+		return err
+	}
+
+	err = host.Refs.massageConfig()
+	if err != nil {
+		return err
+	}
+
+	if host.Lfs.MaxObjectSizeMB < 0 || host.Lfs.MaxTotalSizeMB < 0 {
+		return errors.New("LFS size limits cannot be negative")
+	}
+
+	switch host.RefListing {
+	case "":
+		host.RefListing = "api"
+	case "api", "git":
+	default:
+		return fmt.Errorf("invalid ref listing: %s (expected api or git)", host.RefListing)
+	}
+
+	if validator != nil {
+		return validator(host)
+	}
+
 	return nil
 }
 
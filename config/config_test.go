@@ -0,0 +1,42 @@
+package config
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRefPatternsInherit(t *testing.T) {
+	global := RefPatterns{
+		Include: []string{"refs/heads/*", "refs/tags/*"},
+		Exclude: []string{"refs/heads/dependabot/*"},
+	}
+
+	tests := []struct {
+		name     string
+		host     RefPatterns
+		expected RefPatterns
+	}{
+		{"none", RefPatterns{}, global},
+		{
+			"include only",
+			RefPatterns{Include: []string{"refs/heads/*"}},
+			RefPatterns{Include: []string{"refs/heads/*"}, Exclude: []string{"refs/heads/dependabot/*"}},
+		},
+		{
+			"exclude only",
+			RefPatterns{Exclude: []string{"refs/tags/nightly-*"}},
+			RefPatterns{Include: global.Include, Exclude: []string{"refs/heads/dependabot/*", "refs/tags/nightly-*"}},
+		},
+	}
+
+	for _, test := range tests {
+		test.host.inherit(global)
+		if !slices.Equal(test.host.Include, test.expected.Include) || !slices.Equal(test.host.Exclude, test.expected.Exclude) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, test.host)
+		}
+	}
+
+	if len(global.Exclude) != 1 {
+		t.Errorf("global patterns were modified: %+v", global)
+	}
+}
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Validator checks and fills in the provider-specific parts of a host
+// configuration. It runs after environment variables have been expanded.
+type Validator func(host *Host) error
+
+var validators = map[string]Validator{}
+
+// Register the validator for a host type. Only hosts whose type has been
+// registered are accepted when loading the configuration.
+func RegisterHostType(hostType string, validator Validator) {
+	if _, found := validators[hostType]; found {
+		panic(fmt.Sprintf("host type %s registered twice", hostType))
+	}
+
+	validators[hostType] = validator
+}
+
+func registeredHostTypes() string {
+	types := []string{}
+	for hostType := range validators {
+		types = append(types, hostType)
+	}
+
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// Decode the provider-specific options block of a host into target. Unknown
+// keys are rejected so typos don't silently fall back to defaults.
+func (host *Host) DecodeOptions(target any) error {
+	if host.Options.IsZero() {
+		return nil
+	}
+
+	raw, err := yaml.Marshal(&host.Options)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(raw))
+	decoder.KnownFields(true)
+
+	err = decoder.Decode(target)
+	if err != nil {
+		return fmt.Errorf("invalid options for %s host: %w", host.Type, err)
+	}
+
+	return nil
+}
@@ -2,11 +2,16 @@ package constants
 
 const BACKUP_PREFIX = "[backup]"
 const IGNORE_PREFIX = "[ignore]"
+const WIKI_PREFIX = "[wiki]"
 const BACKUP_LABEL = "gitr-backup"
 const PRIVATE_LABEL = "private"
+const ORPHANED_LABEL = "orphaned"
 
 type ContextKey int
 
 const (
 	DRY_RUN ContextKey = iota
+	CACHE_DIR
+	HOST_JITTER
+	FORCE_DESTRUCTIVE
 )
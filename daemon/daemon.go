@@ -0,0 +1,289 @@
+package daemon
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"gitr-backup/config"
+	"gitr-backup/constants"
+	"gitr-backup/metrics"
+	"gitr-backup/sync"
+	"net/http"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Called with the outcome of every run, e.g. to write reports
+type RunHook func(report *sync.Report, err error)
+
+type runStatus struct {
+	Reason    string    `json:"reason"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at,omitzero"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type status struct {
+	Running bool       `json:"running"`
+	NextRun time.Time  `json:"next_run,omitzero"`
+	Current *runStatus `json:"current,omitempty"`
+	LastRun *runStatus `json:"last_run,omitempty"`
+}
+
+// Runs the synchronization on a schedule and on push webhooks, and serves the
+// health, readiness, trigger and metrics endpoints
+type Daemon struct {
+	ctx    context.Context
+	stop   context.CancelFunc
+	config *config.Config
+	index  *sync.Index
+	// Called after full runs and after webhook runs respectively
+	hook        RunHook
+	webhookHook RunHook
+
+	// Held for the duration of a run, so runs never overlap
+	running gosync.Mutex
+	// Held while pushing, so webhook runs and full runs never update the
+	// same backups at once
+	syncing gosync.Mutex
+	runs    gosync.WaitGroup
+	ready   atomic.Bool
+
+	mtx      gosync.Mutex
+	status   status
+	webhooks chan string
+	pending  map[string]struct{}
+
+	// Set once Serve waits for the runs, which can't start anymore
+	shuttingDown bool
+}
+
+func New(ctx context.Context, config *config.Config, hook RunHook, webhookHook RunHook) *Daemon {
+	ctx, stop := context.WithCancel(context.WithValue(ctx, constants.HOST_JITTER, config.Daemon.Jitter))
+
+	return &Daemon{
+		ctx:         ctx,
+		stop:        stop,
+		config:      config,
+		index:       sync.NewIndex(config),
+		hook:        hook,
+		webhookHook: webhookHook,
+		webhooks:    make(chan string, webhookQueueSize),
+		pending:     map[string]struct{}{},
+	}
+}
+
+// Start a run in the background, unless one is in progress already
+func (daemon *Daemon) trigger(reason string) bool {
+	if !daemon.running.TryLock() {
+		return false
+	}
+
+	current := &runStatus{Reason: reason, StartedAt: time.Now()}
+
+	daemon.mtx.Lock()
+	if daemon.shuttingDown {
+		daemon.mtx.Unlock()
+		daemon.running.Unlock()
+		return false
+	}
+
+	daemon.status.Running = true
+	daemon.status.Current = current
+	daemon.runs.Add(1)
+	daemon.mtx.Unlock()
+
+	go func() {
+		defer daemon.runs.Done()
+		defer daemon.running.Unlock()
+
+		logger := log.With().Str("reason", reason).Logger()
+
+		// Wait for the current webhook run, if any
+		daemon.syncing.Lock()
+		defer daemon.syncing.Unlock()
+
+		logger.Info().Msg("Starting synchronization")
+
+		report, err := daemon.index.SyncHosts(daemon.ctx, nil)
+		if err != nil {
+			logger.Error().Err(err).Msg("Synchronization failed")
+		} else {
+			logger.Info().Msg("Synchronization done")
+		}
+
+		if daemon.hook != nil {
+			daemon.hook(report, err)
+		}
+
+		last := *current
+		last.EndedAt = time.Now()
+		if err != nil {
+			last.Error = err.Error()
+		}
+
+		daemon.mtx.Lock()
+		daemon.status.Running = false
+		daemon.status.Current = nil
+		daemon.status.LastRun = &last
+		daemon.mtx.Unlock()
+	}()
+
+	return true
+}
+
+func (daemon *Daemon) schedule() error {
+	schedule, err := daemon.config.Daemon.ParseSchedule()
+	if err != nil {
+		return err
+	}
+
+	for {
+		next := schedule.Next(time.Now())
+
+		daemon.mtx.Lock()
+		daemon.status.NextRun = next
+		daemon.mtx.Unlock()
+
+		log.Info().Time("next_run", next).Msg("Waiting for next run")
+
+		select {
+		case <-daemon.ctx.Done():
+			return nil
+		case <-time.After(time.Until(next)):
+		}
+
+		if !daemon.trigger("schedule") {
+			log.Warn().Msg("Previous run still in progress, skipping scheduled run")
+		}
+	}
+}
+
+func (daemon *Daemon) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+func (daemon *Daemon) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !daemon.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+func (daemon *Daemon) handleStatus(w http.ResponseWriter, r *http.Request) {
+	daemon.mtx.Lock()
+	raw, err := json.Marshal(&daemon.status)
+	daemon.mtx.Unlock()
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
+
+func (daemon *Daemon) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if token := daemon.config.Daemon.TriggerToken; token != "" {
+		provided, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if daemon.ctx.Err() != nil {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !daemon.trigger("manual") {
+		http.Error(w, "a run is already in progress", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("started\n"))
+}
+
+// Run the daemon until the context is cancelled, then wait for the current
+// run to finish
+func (daemon *Daemon) Serve() error {
+	if daemon.config.Daemon.Schedule == "" {
+		return errors.New("no schedule configured for the daemon")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", daemon.handleHealth)
+	mux.HandleFunc("/readyz", daemon.handleReady)
+	mux.HandleFunc("/status", daemon.handleStatus)
+	mux.HandleFunc("/trigger", daemon.handleTrigger)
+	mux.HandleFunc("/webhook/{host}", daemon.handleWebhook)
+	mux.Handle("/metrics", metrics.Handler())
+
+	server := &http.Server{
+		Addr:              daemon.config.Daemon.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Info().Str("listen", server.Addr).Msg("Listening")
+		serverErr <- server.ListenAndServe()
+	}()
+
+	daemon.runs.Add(1)
+	go func() {
+		defer daemon.runs.Done()
+		daemon.processWebhooks()
+	}()
+
+	daemon.ready.Store(true)
+
+	scheduleErr := make(chan error, 1)
+	go func() {
+		scheduleErr <- daemon.schedule()
+	}()
+
+	var err error
+	select {
+	case err = <-serverErr:
+	case err = <-scheduleErr:
+	case <-daemon.ctx.Done():
+	}
+
+	daemon.ready.Store(false)
+	daemon.stop()
+
+	daemon.mtx.Lock()
+	daemon.shuttingDown = true
+	daemon.mtx.Unlock()
+
+	log.Info().Msg("Shutting down, waiting for the current runs to finish")
+	daemon.runs.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	shutdownErr := server.Shutdown(ctx)
+	if err == nil || errors.Is(err, http.ErrServerClosed) {
+		err = shutdownErr
+	}
+
+	return err
+}
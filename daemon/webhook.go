@@ -0,0 +1,201 @@
+package daemon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"gitr-backup/config"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// GitHub doesn't deliver larger payloads
+const maxWebhookSize = 25 * 1024 * 1024
+
+// Repositories waiting to be synchronized after a push
+const webhookQueueSize = 100
+
+// Fields of the push payloads of all the supported hosts
+type pushPayload struct {
+	Repository struct {
+		HtmlUrl string `json:"html_url"`
+	} `json:"repository"`
+	Project struct {
+		WebUrl string `json:"web_url"`
+	} `json:"project"`
+}
+
+func (payload *pushPayload) repositoryUrl() string {
+	if payload.Project.WebUrl != "" {
+		return payload.Project.WebUrl
+	}
+
+	return payload.Repository.HtmlUrl
+}
+
+func checkHmac(secret string, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// Check the authenticity of a webhook delivery, and return whether it is a
+// push event
+func verifyWebhook(host *config.Host, r *http.Request, body []byte) (bool, error) {
+	switch host.Type {
+	case "github":
+		signature, found := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+		if !found || !checkHmac(host.WebhookSecret, body, signature) {
+			return false, errors.New("invalid signature")
+		}
+
+		return r.Header.Get("X-GitHub-Event") == "push", nil
+	case "gitea":
+		if !checkHmac(host.WebhookSecret, body, r.Header.Get("X-Gitea-Signature")) {
+			return false, errors.New("invalid signature")
+		}
+
+		return r.Header.Get("X-Gitea-Event") == "push", nil
+	case "gitlab":
+		// GitLab doesn't sign payloads, the secret is sent as is
+		token := r.Header.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(host.WebhookSecret)) != 1 {
+			return false, errors.New("invalid token")
+		}
+
+		event := r.Header.Get("X-Gitlab-Event")
+		return event == "Push Hook" || event == "Tag Push Hook", nil
+	}
+
+	return false, errors.New("webhooks are not supported for this host type")
+}
+
+func (daemon *Daemon) findHost(name string) *config.Host {
+	for i := range daemon.config.Hosts {
+		host := &daemon.config.Hosts[i]
+		if host.Name == name && host.Usage == "source" {
+			return host
+		}
+	}
+
+	return nil
+}
+
+func (daemon *Daemon) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host := daemon.findHost(r.PathValue("host"))
+	if host == nil {
+		http.Error(w, "unknown source host", http.StatusNotFound)
+		return
+	}
+
+	logger := log.With().Str("host", host.Name).Logger()
+
+	if host.WebhookSecret == "" {
+		http.Error(w, "webhooks are not enabled for this host", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookSize))
+	if err != nil {
+		http.Error(w, "failed reading payload", http.StatusBadRequest)
+		return
+	}
+
+	isPush, err := verifyWebhook(host, r, body)
+	if err != nil {
+		logger.Warn().Err(err).Str("remote", r.RemoteAddr).Msg("Rejected webhook")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Other events, such as pings, are acknowledged and ignored
+	if !isPush {
+		w.Write([]byte("ignored\n"))
+		return
+	}
+
+	payload := pushPayload{}
+	err = json.Unmarshal(body, &payload)
+	if err != nil || payload.repositoryUrl() == "" {
+		http.Error(w, "invalid push payload", http.StatusBadRequest)
+		return
+	}
+
+	if !daemon.enqueue(payload.repositoryUrl()) {
+		http.Error(w, "too many pending repositories", http.StatusServiceUnavailable)
+		return
+	}
+
+	logger.Info().Str("repository", payload.repositoryUrl()).Msg("Received push webhook")
+
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("queued\n"))
+}
+
+// Queue a repository for synchronization, unless it is already waiting
+func (daemon *Daemon) enqueue(repoUrl string) bool {
+	daemon.mtx.Lock()
+	defer daemon.mtx.Unlock()
+
+	if _, found := daemon.pending[repoUrl]; found {
+		return true
+	}
+
+	select {
+	case daemon.webhooks <- repoUrl:
+		daemon.pending[repoUrl] = struct{}{}
+		return true
+	default:
+		return false
+	}
+}
+
+// Synchronize the repositories notified by webhooks, one at a time
+func (daemon *Daemon) processWebhooks() {
+	for {
+		var repoUrl string
+		select {
+		case <-daemon.ctx.Done():
+			return
+		case repoUrl = <-daemon.webhooks:
+		}
+
+		// Pushes received from now on need another synchronization
+		daemon.mtx.Lock()
+		delete(daemon.pending, repoUrl)
+		daemon.mtx.Unlock()
+
+		daemon.syncing.Lock()
+		if daemon.ctx.Err() != nil {
+			daemon.syncing.Unlock()
+			return
+		}
+
+		report, err := daemon.index.SyncSourceRepository(daemon.ctx, repoUrl)
+		if err != nil {
+			log.Error().Err(err).Str("repository", repoUrl).Msg("Failed synchronizing pushed repository")
+		}
+
+		if daemon.webhookHook != nil {
+			daemon.webhookHook(report, err)
+		}
+		daemon.syncing.Unlock()
+	}
+}
@@ -0,0 +1,91 @@
+package daemon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"gitr-backup/config"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestCheckHmac(t *testing.T) {
+	body := []byte(`{"ref":"refs/heads/main"}`)
+
+	tests := []struct {
+		name      string
+		signature string
+		expected  bool
+	}{
+		{"valid", sign("secret", string(body)), true},
+		{"other secret", sign("other", string(body)), false},
+		{"other body", sign("secret", "{}"), false},
+		{"not hex", "not-a-signature", false},
+		{"empty", "", false},
+	}
+
+	for _, test := range tests {
+		if valid := checkHmac("secret", body, test.signature); valid != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, valid)
+		}
+	}
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	const body = `{"repository":{"html_url":"https://example.com/owner/repo"}}`
+	valid := sign("secret", body)
+
+	tests := []struct {
+		name     string
+		hostType string
+		headers  map[string]string
+		isPush   bool
+		fails    bool
+	}{
+		{"github push", "github", map[string]string{"X-Hub-Signature-256": "sha256=" + valid, "X-GitHub-Event": "push"}, true, false},
+		{"github ping", "github", map[string]string{"X-Hub-Signature-256": "sha256=" + valid, "X-GitHub-Event": "ping"}, false, false},
+		{"github missing prefix", "github", map[string]string{"X-Hub-Signature-256": valid, "X-GitHub-Event": "push"}, false, true},
+		{"github bad signature", "github", map[string]string{"X-Hub-Signature-256": "sha256=" + sign("other", body), "X-GitHub-Event": "push"}, false, true},
+		{"github missing signature", "github", map[string]string{"X-GitHub-Event": "push"}, false, true},
+		{"gitea push", "gitea", map[string]string{"X-Gitea-Signature": valid, "X-Gitea-Event": "push"}, true, false},
+		{"gitea issues", "gitea", map[string]string{"X-Gitea-Signature": valid, "X-Gitea-Event": "issues"}, false, false},
+		{"gitea bad signature", "gitea", map[string]string{"X-Gitea-Signature": sign("other", body), "X-Gitea-Event": "push"}, false, true},
+		{"gitea missing signature", "gitea", map[string]string{"X-Gitea-Event": "push"}, false, true},
+		{"gitlab push", "gitlab", map[string]string{"X-Gitlab-Token": "secret", "X-Gitlab-Event": "Push Hook"}, true, false},
+		{"gitlab tag push", "gitlab", map[string]string{"X-Gitlab-Token": "secret", "X-Gitlab-Event": "Tag Push Hook"}, true, false},
+		{"gitlab merge request", "gitlab", map[string]string{"X-Gitlab-Token": "secret", "X-Gitlab-Event": "Merge Request Hook"}, false, false},
+		{"gitlab token mismatch", "gitlab", map[string]string{"X-Gitlab-Token": "other", "X-Gitlab-Event": "Push Hook"}, false, true},
+		{"gitlab missing token", "gitlab", map[string]string{"X-Gitlab-Event": "Push Hook"}, false, true},
+		{"unsupported host", "filesystem", map[string]string{}, false, true},
+	}
+
+	for _, test := range tests {
+		host := &config.Host{Name: "source", Type: test.hostType, WebhookSecret: "secret"}
+
+		r := httptest.NewRequest("POST", "/webhook/source", strings.NewReader(body))
+		for key, value := range test.headers {
+			r.Header.Set(key, value)
+		}
+
+		isPush, err := verifyWebhook(host, r, []byte(body))
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if isPush != test.isPush {
+			t.Errorf("%s: expected push %v, got %v", test.name, test.isPush, isPush)
+		}
+	}
+}
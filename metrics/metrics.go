@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gitr_backup"
+
+// Backup metrics, without the runtime metrics of the process so they can be
+// written to a textfile for node_exporter
+var Registry = prometheus.NewRegistry()
+
+var (
+	RepositoryLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "repository_last_success_timestamp_seconds",
+		Help:      "Time of the last successful synchronization of a backup repository.",
+	}, []string{"destination", "repository"})
+
+	RepositoryResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "repository_results_total",
+		Help:      "Repositories processed, by action taken.",
+	}, []string{"destination", "action"})
+
+	RefsChanged = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "refs_changed_total",
+		Help:      "Refs updated, deleted or preserved in backup repositories.",
+	}, []string{"destination", "repository", "kind"})
+
+	TransferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "transferred_bytes_total",
+		Help:      "Bytes fetched from sources and pushed to destinations.",
+	}, []string{"direction"})
+
+	ApiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_requests_total",
+		Help:      "Requests to the API of a host, by status code.",
+	}, []string{"host", "code"})
+
+	ApiErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_errors_total",
+		Help:      "Requests to the API of a host which failed, or returned a server error.",
+	}, []string{"host"})
+
+	OrphanedRepositories = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "orphaned_repositories",
+		Help:      "Backup repositories whose source could not be found.",
+	}, []string{"destination"})
+
+	LastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_run_timestamp_seconds",
+		Help:      "Time at which the last synchronization ended, by outcome.",
+	}, []string{"outcome"})
+
+	LastRunDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_run_duration_seconds",
+		Help:      "Duration of the last synchronization.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		RepositoryLastSuccess,
+		RepositoryResults,
+		RefsChanged,
+		TransferredBytes,
+		ApiRequests,
+		ApiErrors,
+		OrphanedRepositories,
+		LastRun,
+		LastRunDuration,
+	)
+}
+
+// Serve the backup metrics along with the runtime metrics of the process
+func Handler() http.Handler {
+	runtime := prometheus.NewRegistry()
+	runtime.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return promhttp.HandlerFor(prometheus.Gatherers{Registry, runtime}, promhttp.HandlerOpts{})
+}
+
+// Write the backup metrics for the node_exporter textfile collector. The file
+// is replaced atomically, and should have a .prom extension.
+func WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, Registry)
+}
@@ -0,0 +1,338 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitr-backup/config"
+	"gitr-backup/constants"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+// File touched every time a cached mirror is used, for garbage collection
+const cacheStampName = "gitr-backup-last-used"
+
+var unsafePathChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// A bare mirror of a source repository, kept across runs
+type cachedMirror struct {
+	path string
+	repo *git.Repository
+	lock *os.File
+	// Size of the last fetch
+	fetchedBytes uint64
+}
+
+// Get the path of the mirror of a repository in the cache, derived from its
+// url so repositories with the same name on different hosts don't collide.
+func cachePath(cacheDir, repoUrl string) string {
+	parts := []string{cacheDir}
+
+	parsed, err := url.Parse(repoUrl)
+	if err != nil || parsed.Host == "" {
+		parts = append(parts, unsafePathChars.ReplaceAllString(repoUrl, "_"))
+	} else {
+		parts = append(parts, unsafePathChars.ReplaceAllString(parsed.Host, "_"))
+		for _, segment := range strings.Split(strings.Trim(parsed.Path, "/"), "/") {
+			if segment == "" || segment == "." || segment == ".." {
+				continue
+			}
+
+			parts = append(parts, unsafePathChars.ReplaceAllString(segment, "_"))
+		}
+	}
+
+	return strings.TrimSuffix(filepath.Join(parts...), ".git") + ".git"
+}
+
+// Take an exclusive lock on a mirror, waiting for other users to release it
+func lockMirror(ctx context.Context, path string, wait bool) (*os.File, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return lock, nil
+		}
+
+		if !errors.Is(err, syscall.EWOULDBLOCK) || !wait {
+			lock.Close()
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			lock.Close()
+			return nil, ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
+
+func (mirror *cachedMirror) Release() {
+	if mirror.repo != nil {
+		mirror.repo.Free()
+	}
+
+	_ = syscall.Flock(int(mirror.lock.Fd()), syscall.LOCK_UN)
+	mirror.lock.Close()
+}
+
+// Open the cached mirror of a source repository, creating it if needed, and
+// fetch the latest refs into it. The mirror must be released by the caller.
+func openCachedMirror(ctx context.Context, logger zerolog.Logger, cacheDir string, sourceRepo repository.Repository) (*cachedMirror, error) {
+	path := cachePath(cacheDir, sourceRepo.GetUrl())
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := lockMirror(ctx, path, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed locking cached mirror: %w", err)
+	}
+
+	mirror := &cachedMirror{path: path, lock: lock}
+
+	mirror.repo, err = git.OpenRepository(path)
+	if err != nil {
+		logger.Info().Str("path", path).Msg("Creating cached mirror")
+		mirror.repo, err = git.InitRepository(path, true)
+	}
+
+	if err != nil {
+		mirror.Release()
+		return nil, err
+	}
+
+	sourceCloneUrl, err := sourceRepo.GetHttpsCloneUrl()
+	if err != nil {
+		mirror.Release()
+		return nil, err
+	}
+
+	// Use an anonymous remote so credentials embedded in the url are not
+	// persisted in the configuration of the mirror
+	remote, err := mirror.repo.Remotes.CreateAnonymous(sourceCloneUrl)
+	if err != nil {
+		mirror.Release()
+		return nil, err
+	}
+	defer remote.Free()
+
+	logger.Info().Str("path", path).Str("clone_url", safeUrl(sourceCloneUrl)).Msg("Fetching into cached mirror")
+
+	err = remote.Fetch([]string{"+refs/*:refs/*"}, &git.FetchOptions{
+		Prune:        git.FetchPruneOn,
+		DownloadTags: git.DownloadTagsAll,
+		RemoteCallbacks: git.RemoteCallbacks{
+			CredentialsCallback: vcs.CredentialsCallback,
+			TransferProgressCallback: func(stats git.TransferProgress) error {
+				mirror.fetchedBytes = uint64(stats.ReceivedBytes)
+				return nil
+			},
+		},
+	}, "")
+	if err != nil {
+		mirror.Release()
+		return nil, err
+	}
+
+	now := time.Now()
+	err = os.WriteFile(filepath.Join(path, cacheStampName), []byte(now.Format(time.RFC3339)+"\n"), 0o644)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed updating cache stamp")
+	}
+
+	size, err := dirSize(path)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed computing cached mirror size")
+	}
+
+	logger.Info().Uint64("fetched_bytes", mirror.fetchedBytes).Int64("size", size).Msg("Cached mirror up to date")
+
+	return mirror, nil
+}
+
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			size += info.Size()
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+type cacheEntry struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// Get the last time a mirror was used
+func mirrorLastUsed(path string) (time.Time, error) {
+	stamp, err := os.Stat(filepath.Join(path, cacheStampName))
+	if err != nil {
+		// Not a mirror created by us, or never fetched successfully
+		stamp, err = os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	return stamp.ModTime(), nil
+}
+
+func listCacheEntries(cacheDir string) ([]cacheEntry, error) {
+	entries := []cacheEntry{}
+	err := filepath.WalkDir(cacheDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.IsDir() || !strings.HasSuffix(path, ".git") {
+			return nil
+		}
+
+		lastUsed, err := mirrorLastUsed(path)
+		if err != nil {
+			return err
+		}
+
+		size, err := dirSize(path)
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, cacheEntry{path: path, size: size, lastUsed: lastUsed})
+		return filepath.SkipDir
+	})
+
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+
+	return entries, err
+}
+
+func removeCacheEntry(ctx context.Context, logger zerolog.Logger, entry cacheEntry, reason string) bool {
+	lock, err := lockMirror(ctx, entry.path, false)
+	if err != nil {
+		logger.Info().Str("path", entry.path).Msg("Mirror in use, skipping")
+		return false
+	}
+	defer lock.Close()
+
+	// Another process may have used the mirror between the listing and
+	// taking the lock, so the reason to remove it may not hold anymore
+	lastUsed, err := mirrorLastUsed(entry.path)
+	if err != nil {
+		logger.Warn().Err(err).Str("path", entry.path).Msg("Failed checking cached mirror, skipping")
+		return false
+	}
+
+	if lastUsed.After(entry.lastUsed) {
+		logger.Info().Str("path", entry.path).Time("last_used", lastUsed).Msg("Mirror used since listing, skipping")
+		return false
+	}
+
+	logger.Info().Str("path", entry.path).Int64("size", entry.size).Str("reason", reason).Msg("Removing cached mirror")
+
+	// The lock file stays: other processes may have it open already, and
+	// would lock a different file than the ones opening it afterwards
+	err = os.RemoveAll(entry.path)
+	if err != nil {
+		logger.Error().Err(err).Str("path", entry.path).Msg("Failed removing cached mirror")
+		return false
+	}
+
+	return true
+}
+
+// Remove the mirrors that have not been used for longer than the maximum age,
+// then the least recently used ones until the cache fits in its maximum size.
+func GarbageCollectCache(ctx context.Context, cache config.Cache) error {
+	logger := log.With().Str("cache", cache.Path).Logger()
+
+	if cache.Path == "" {
+		return errors.New("no cache directory configured")
+	}
+
+	entries, err := listCacheEntries(cache.Path)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed.Before(entries[j].lastUsed)
+	})
+
+	var totalSize int64
+	for _, entry := range entries {
+		totalSize += entry.size
+	}
+
+	logger.Info().Int("mirrors", len(entries)).Int64("size", totalSize).Msg("Analyzed cache")
+
+	dryRun := ctx.Value(constants.DRY_RUN).(bool)
+	maxSize := cache.MaxSizeMB * 1024 * 1024
+	removedCount := 0
+
+	for _, entry := range entries {
+		reason := ""
+		if cache.MaxAge > 0 && time.Since(entry.lastUsed) > cache.MaxAge {
+			reason = "expired"
+		} else if maxSize > 0 && totalSize > maxSize {
+			reason = "size"
+		} else {
+			continue
+		}
+
+		if dryRun {
+			logger.Info().Str("path", entry.path).Str("reason", reason).Msg("Would remove cached mirror, but dry-run mode is enabled")
+			totalSize -= entry.size
+			continue
+		}
+
+		if removeCacheEntry(ctx, logger, entry, reason) {
+			totalSize -= entry.size
+			removedCount += 1
+		}
+	}
+
+	logger.Info().Int("removed", removedCount).Int64("size", totalSize).Msg("Cache garbage collection done")
+
+	return nil
+}
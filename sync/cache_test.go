@@ -0,0 +1,66 @@
+package sync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestRemoveCacheEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "git.example.com", "owner", "repo.git")
+	err := os.MkdirAll(path, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stamp := filepath.Join(path, cacheStampName)
+	listedAt := time.Now().Add(-time.Hour)
+	err = os.WriteFile(stamp, nil, 0o644)
+	if err == nil {
+		err = os.Chtimes(stamp, listedAt, listedAt)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := listCacheEntries(filepath.Dir(filepath.Dir(filepath.Dir(path))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || !entries[0].lastUsed.Equal(listedAt) {
+		t.Fatalf("unexpected cache entries: %+v", entries)
+	}
+
+	// Used by another process after the listing
+	usedAt := time.Now()
+	err = os.Chtimes(stamp, usedAt, usedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removeCacheEntry(context.Background(), zerolog.Nop(), entries[0], "expired") {
+		t.Fatal("removed a mirror used since the listing")
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	entries[0].lastUsed = usedAt
+	if !removeCacheEntry(context.Background(), zerolog.Nop(), entries[0], "expired") {
+		t.Fatal("expected the mirror to be removed")
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the mirror to be gone, got %v", err)
+	}
+
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Fatalf("expected the lock file to stay: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package sync
+
+import (
+	"context"
+	"gitr-backup/config"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+	"sync"
+)
+
+// Clients of the hosts and backups of the source repositories, kept between
+// the runs of a daemon so that synchronizing a single repository doesn't log
+// in to every host and list all their repositories again
+type Index struct {
+	config  *config.Config
+	mtx     sync.Mutex
+	clients []vcs.Vcs
+	// Url of the backup of each normalized source url, per destination
+	backups map[string]map[string]string
+}
+
+func NewIndex(config *config.Config) *Index {
+	return &Index{
+		config:  config,
+		backups: map[string]map[string]string{},
+	}
+}
+
+// Get the clients of the hosts, logging in on first use
+func (index *Index) getClients(ctx context.Context) ([]vcs.Vcs, error) {
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	if index.clients == nil {
+		clients, err := vcs.LoadClients(ctx, index.config)
+		if err != nil {
+			return nil, err
+		}
+
+		index.clients = clients
+	}
+
+	return index.clients, nil
+}
+
+func (index *Index) getBackupUrl(destination vcs.Vcs, sourceUrl string) (string, bool) {
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	backupUrl, found := index.backups[destination.GetConfig().Name][sourceUrl]
+	return backupUrl, found
+}
+
+func (index *Index) setBackupUrl(destination vcs.Vcs, sourceUrl, backupUrl string) {
+	index.mtx.Lock()
+	defer index.mtx.Unlock()
+
+	name := destination.GetConfig().Name
+	if index.backups[name] == nil {
+		index.backups[name] = map[string]string{}
+	}
+
+	if backupUrl == "" {
+		delete(index.backups[name], sourceUrl)
+	} else {
+		index.backups[name][sourceUrl] = backupUrl
+	}
+}
+
+// Record the backup of a source repository, if the run keeps an index
+func (state *syncContext) indexBackup(destination vcs.Vcs, sourceUrl string, backupRepo repository.Repository) {
+	if state.index == nil {
+		return
+	}
+
+	normalized, err := normalizePrefix(sourceUrl)
+	if err != nil {
+		return
+	}
+
+	state.index.setBackupUrl(destination, normalized, backupRepo.GetUrl())
+}
+
+// Find the backup of a source repository in a destination, through the index
+// if possible. Backups which are not indexed yet, or which were moved since,
+// are looked for in the listing of the destination.
+func (index *Index) findBackup(ctx context.Context, destination vcs.Vcs, normalized string) (repository.Repository, error) {
+	logger := vcs.GetLogger(destination)
+
+	isBackupOf := func(repo repository.Repository) bool {
+		backupUrl, _ := parseBackupDescription(repo.GetDescription())
+		backupUrl, err := normalizePrefix(backupUrl)
+		return err == nil && backupUrl == normalized
+	}
+
+	if backupUrl, found := index.getBackupUrl(destination, normalized); found {
+		repo, err := destination.GetRepositoryByUrl(ctx, backupUrl)
+		if err == nil && isBackupOf(*repo) {
+			return *repo, nil
+		}
+
+		logger.Debug().Err(err).Str("backup", backupUrl).Msg("Indexed backup not found, listing the destination")
+		index.setBackupUrl(destination, normalized, "")
+	}
+
+	destRepos, err := destination.GetRepositories(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, destRepo := range destRepos {
+		if isBackupOf(destRepo) {
+			index.setBackupUrl(destination, normalized, destRepo.GetUrl())
+			return destRepo, nil
+		}
+	}
+
+	return nil, nil
+}
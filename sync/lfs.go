@@ -0,0 +1,408 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gitr-backup/config"
+	"gitr-backup/metrics"
+	"gitr-backup/vcs/repository"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+// Pointer files are smaller than this, per the LFS specification
+const maxLfsPointerSize = 1024
+
+// Objects per batch API request
+const lfsBatchSize = 100
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+var lfsOidPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+type lfsObject struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+func parseLfsPointer(contents []byte) (lfsObject, bool) {
+	object := lfsObject{Size: -1}
+	if !bytes.HasPrefix(contents, []byte("version https://git-lfs.github.com/spec/")) {
+		return object, false
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "oid":
+			object.Oid, _ = strings.CutPrefix(value, "sha256:")
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err == nil {
+				object.Size = size
+			}
+		}
+	}
+
+	return object, lfsOidPattern.MatchString(object.Oid) && object.Size >= 0
+}
+
+// Find the LFS objects referenced by the commits about to be pushed. Commits
+// reachable from the destination refs are skipped, if they are known locally.
+func findLfsObjects(repo *git.Repository, changelog RefdiffResult, destRefs []repository.Ref) ([]lfsObject, error) {
+	walk, err := repo.Walk()
+	if err != nil {
+		return nil, err
+	}
+	defer walk.Free()
+
+	pushed := 0
+	for _, ref := range changelog.ChangedRefs {
+		oid, err := git.NewOid(ref.Peeled)
+		if err == nil && walk.Push(oid) == nil {
+			pushed += 1
+		}
+	}
+
+	if pushed == 0 {
+		return nil, nil
+	}
+
+	for _, ref := range destRefs {
+		oid, err := git.NewOid(ref.Peeled)
+		if err == nil {
+			_ = walk.Hide(oid)
+		}
+	}
+
+	odb, err := repo.Odb()
+	if err != nil {
+		return nil, err
+	}
+	defer odb.Free()
+
+	// Trees and blobs shared between commits are only looked at once
+	seen := map[git.Oid]struct{}{}
+	found := map[string]lfsObject{}
+
+	checkEntry := func(_ string, entry *git.TreeEntry) error {
+		if _, ok := seen[*entry.Id]; ok {
+			return git.TreeWalkSkip
+		}
+		seen[*entry.Id] = struct{}{}
+
+		if entry.Type != git.ObjectBlob {
+			return nil
+		}
+
+		size, _, err := odb.ReadHeader(entry.Id)
+		if err != nil {
+			return err
+		}
+
+		if size >= maxLfsPointerSize {
+			return nil
+		}
+
+		blob, err := repo.LookupBlob(entry.Id)
+		if err != nil {
+			return err
+		}
+		defer blob.Free()
+
+		if object, ok := parseLfsPointer(blob.Contents()); ok {
+			found[object.Oid] = object
+		}
+
+		return nil
+	}
+
+	var walkErr error
+	err = walk.Iterate(func(commit *git.Commit) bool {
+		defer commit.Free()
+
+		tree, err := commit.Tree()
+		if err != nil {
+			walkErr = err
+			return false
+		}
+		defer tree.Free()
+
+		walkErr = tree.Walk(checkEntry)
+		return walkErr == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if walkErr != nil {
+		return nil, walkErr
+	}
+
+	objects := []lfsObject{}
+	for _, object := range found {
+		objects = append(objects, object)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Oid < objects[j].Oid
+	})
+
+	return objects, nil
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+type lfsBatchObject struct {
+	lfsObject
+	Actions map[string]lfsAction `json:"actions"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type lfsBatchRequest struct {
+	Operation string      `json:"operation"`
+	Transfers []string    `json:"transfers"`
+	Objects   []lfsObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsBatchObject `json:"objects"`
+}
+
+// LFS server of a repository, derived from its clone url
+type lfsEndpoint struct {
+	batchUrl *url.URL
+	user     *url.Userinfo
+}
+
+func newLfsEndpoint(cloneUrl string) (*lfsEndpoint, error) {
+	parsed, err := url.Parse(cloneUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if parsed.Scheme != "https" && parsed.Scheme != "http" {
+		return nil, fmt.Errorf("no LFS server for %s urls", parsed.Scheme)
+	}
+
+	user := parsed.User
+	parsed.User = nil
+	parsed.Path = strings.TrimSuffix(parsed.Path, ".git") + ".git/info/lfs/objects/batch"
+
+	return &lfsEndpoint{batchUrl: parsed, user: user}, nil
+}
+
+// Send a request to the LFS server, or to the storage it redirects to. The
+// credentials of the repository are only sent to the LFS server itself.
+func (endpoint *lfsEndpoint) do(ctx context.Context, method, target string, header map[string]string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.ContentLength = size
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	if endpoint.user != nil && req.Header.Get("Authorization") == "" && req.URL.Host == endpoint.batchUrl.Host {
+		password, _ := endpoint.user.Password()
+		req.SetBasicAuth(endpoint.user.Username(), password)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s", method, req.URL.Redacted(), resp.Status)
+	}
+
+	return resp, nil
+}
+
+func (endpoint *lfsEndpoint) batch(ctx context.Context, operation string, objects []lfsObject) ([]lfsBatchObject, error) {
+	body, err := json.Marshal(&lfsBatchRequest{
+		Operation: operation,
+		Transfers: []string{"basic"},
+		Objects:   objects,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	header := map[string]string{"Accept": lfsMediaType, "Content-Type": lfsMediaType}
+	resp, err := endpoint.do(ctx, http.MethodPost, endpoint.batchUrl.String(), header, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := lfsBatchResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Objects, err
+}
+
+// Stream an object from the source to the destination
+func copyLfsObject(ctx context.Context, source, dest *lfsEndpoint, download lfsAction, object lfsBatchObject) error {
+	downloaded, err := source.do(ctx, http.MethodGet, download.Href, download.Header, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer downloaded.Body.Close()
+
+	upload := object.Actions["upload"]
+	uploaded, err := dest.do(ctx, http.MethodPut, upload.Href, upload.Header, downloaded.Body, object.Size)
+	if err != nil {
+		return err
+	}
+	uploaded.Body.Close()
+
+	verify, found := object.Actions["verify"]
+	if !found {
+		return nil
+	}
+
+	body, err := json.Marshal(&object.lfsObject)
+	if err != nil {
+		return err
+	}
+
+	header := map[string]string{"Accept": lfsMediaType, "Content-Type": lfsMediaType}
+	for key, value := range verify.Header {
+		header[key] = value
+	}
+
+	verified, err := dest.do(ctx, http.MethodPost, verify.Href, header, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+
+	return verified.Body.Close()
+}
+
+// Copy the LFS objects referenced by the pushed commits which are missing from
+// the destination, returning the number of objects and bytes copied
+func mirrorLfsObjects(ctx context.Context, logger zerolog.Logger, repo *git.Repository, sourceUrl, destUrl string, changelog RefdiffResult, destRefs []repository.Ref, options config.Lfs) (int, uint64, error) {
+	source, err := newLfsEndpoint(sourceUrl)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Cannot mirror LFS objects from the source")
+		return 0, 0, nil
+	}
+
+	dest, err := newLfsEndpoint(destUrl)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Cannot mirror LFS objects to the destination")
+		return 0, 0, nil
+	}
+
+	objects, err := findLfsObjects(repo, changelog, destRefs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed finding LFS pointers: %w", err)
+	}
+
+	if len(objects) == 0 {
+		return 0, 0, nil
+	}
+
+	logger.Info().Int("objects", len(objects)).Msg("Checking LFS objects")
+
+	selected := []lfsObject{}
+	for _, object := range objects {
+		if options.MaxObjectSizeMB > 0 && object.Size > options.MaxObjectSizeMB<<20 {
+			logger.Warn().Str("oid", object.Oid).Int64("size", object.Size).Msg("Skipping LFS object larger than the size limit")
+			continue
+		}
+
+		selected = append(selected, object)
+	}
+
+	copied := 0
+	var copiedBytes int64
+	for i := 0; i < len(selected); i += lfsBatchSize {
+		window := selected[i:min(i+lfsBatchSize, len(selected))]
+
+		// Objects already present in the destination have no upload action
+		uploads, err := dest.batch(ctx, "upload", window)
+		if err != nil {
+			return copied, uint64(copiedBytes), fmt.Errorf("failed checking destination LFS objects: %w", err)
+		}
+
+		missing := []lfsBatchObject{}
+		missingObjects := []lfsObject{}
+		for _, upload := range uploads {
+			if upload.Error != nil {
+				logger.Warn().Str("oid", upload.Oid).Int("code", upload.Error.Code).Str("error", upload.Error.Message).Msg("LFS object refused by the destination")
+				continue
+			}
+
+			if _, found := upload.Actions["upload"]; found {
+				missing = append(missing, upload)
+				missingObjects = append(missingObjects, upload.lfsObject)
+			}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		downloads, err := source.batch(ctx, "download", missingObjects)
+		if err != nil {
+			return copied, uint64(copiedBytes), fmt.Errorf("failed requesting source LFS objects: %w", err)
+		}
+
+		downloadActions := map[string]lfsAction{}
+		for _, download := range downloads {
+			if action, found := download.Actions["download"]; found {
+				downloadActions[download.Oid] = action
+			}
+		}
+
+		for _, object := range missing {
+			logger := logger.With().Str("oid", object.Oid).Int64("size", object.Size).Logger()
+
+			if options.MaxTotalSizeMB > 0 && copiedBytes+object.Size > options.MaxTotalSizeMB<<20 {
+				logger.Warn().Msg("Skipping LFS object beyond the total size limit")
+				continue
+			}
+
+			download, found := downloadActions[object.Oid]
+			if !found {
+				logger.Warn().Msg("LFS object missing from the source")
+				continue
+			}
+
+			logger.Info().Msg("Copying LFS object")
+			err := copyLfsObject(ctx, source, dest, download, object)
+			if err != nil {
+				return copied, uint64(copiedBytes), fmt.Errorf("failed copying LFS object %s: %w", object.Oid, err)
+			}
+
+			copied += 1
+			copiedBytes += object.Size
+			metrics.TransferredBytes.WithLabelValues("fetch").Add(float64(object.Size))
+			metrics.TransferredBytes.WithLabelValues("push").Add(float64(object.Size))
+		}
+	}
+
+	return copied, uint64(copiedBytes), nil
+}
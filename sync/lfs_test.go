@@ -0,0 +1,193 @@
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testLfsOid = "4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393"
+
+func TestParseLfsPointer(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		expected lfsObject
+		valid    bool
+	}{
+		{
+			"valid",
+			"version https://git-lfs.github.com/spec/v1\noid sha256:" + testLfsOid + "\nsize 12345\n",
+			lfsObject{Oid: testLfsOid, Size: 12345},
+			true,
+		},
+		{
+			"empty object",
+			"version https://git-lfs.github.com/spec/v1\noid sha256:" + testLfsOid + "\nsize 0\n",
+			lfsObject{Oid: testLfsOid, Size: 0},
+			true,
+		},
+		{"short oid", "version https://git-lfs.github.com/spec/v1\noid sha256:4d7a2146\nsize 12345\n", lfsObject{}, false},
+		{"uppercase oid", "version https://git-lfs.github.com/spec/v1\noid sha256:" + strings.ToUpper(testLfsOid) + "\nsize 12345\n", lfsObject{}, false},
+		{"missing size", "version https://git-lfs.github.com/spec/v1\noid sha256:" + testLfsOid + "\n", lfsObject{}, false},
+		{"bad size", "version https://git-lfs.github.com/spec/v1\noid sha256:" + testLfsOid + "\nsize big\n", lfsObject{}, false},
+		{"not a pointer", "oid sha256:" + testLfsOid + "\nsize 12345\n", lfsObject{}, false},
+		{"binary", "\x00\x01\x02", lfsObject{}, false},
+	}
+
+	for _, test := range tests {
+		object, valid := parseLfsPointer([]byte(test.contents))
+		if valid != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.name, test.valid, valid)
+		} else if valid && object != test.expected {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, object)
+		}
+	}
+}
+
+// LFS server storing objects in memory, with the basic transfer adapter
+type lfsStub struct {
+	t       *testing.T
+	server  *httptest.Server
+	mtx     sync.Mutex
+	objects map[string]string
+	// Authorization headers received by the batch endpoint
+	authorizations []string
+	verified       []string
+}
+
+func newLfsStub(t *testing.T, objects map[string]string) *lfsStub {
+	stub := &lfsStub{t: t, objects: objects}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /owner/repo.git/info/lfs/objects/batch", stub.handleBatch)
+	mux.HandleFunc("GET /storage/{oid}", func(w http.ResponseWriter, r *http.Request) {
+		stub.mtx.Lock()
+		defer stub.mtx.Unlock()
+
+		w.Write([]byte(stub.objects[r.PathValue("oid")]))
+	})
+	mux.HandleFunc("PUT /storage/{oid}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("credentials sent to the storage")
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		stub.mtx.Lock()
+		defer stub.mtx.Unlock()
+		stub.objects[r.PathValue("oid")] = string(body)
+	})
+	mux.HandleFunc("POST /verify", func(w http.ResponseWriter, r *http.Request) {
+		object := lfsObject{}
+		_ = json.NewDecoder(r.Body).Decode(&object)
+
+		stub.mtx.Lock()
+		defer stub.mtx.Unlock()
+		stub.verified = append(stub.verified, object.Oid)
+	})
+
+	stub.server = httptest.NewServer(mux)
+	t.Cleanup(stub.server.Close)
+
+	return stub
+}
+
+func (stub *lfsStub) handleBatch(w http.ResponseWriter, r *http.Request) {
+	request := lfsBatchRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stub.mtx.Lock()
+	defer stub.mtx.Unlock()
+
+	stub.authorizations = append(stub.authorizations, r.Header.Get("Authorization"))
+
+	response := lfsBatchResponse{Objects: []lfsBatchObject{}}
+	for _, object := range request.Objects {
+		result := lfsBatchObject{lfsObject: object, Actions: map[string]lfsAction{}}
+		_, found := stub.objects[object.Oid]
+
+		switch {
+		case request.Operation == "download" && found:
+			result.Actions["download"] = lfsAction{Href: stub.server.URL + "/storage/" + object.Oid}
+		case request.Operation == "upload" && !found:
+			result.Actions["upload"] = lfsAction{Href: stub.server.URL + "/storage/" + object.Oid}
+			result.Actions["verify"] = lfsAction{Href: stub.server.URL + "/verify"}
+		}
+
+		response.Objects = append(response.Objects, result)
+	}
+
+	w.Header().Set("Content-Type", lfsMediaType)
+	_ = json.NewEncoder(w).Encode(&response)
+}
+
+func TestCopyLfsObjects(t *testing.T) {
+	const presentOid = "0000000000000000000000000000000000000000000000000000000000000000"
+
+	sourceStub := newLfsStub(t, map[string]string{testLfsOid: "hello world\n", presentOid: "present\n"})
+	destStub := newLfsStub(t, map[string]string{presentOid: "present\n"})
+
+	source, err := newLfsEndpoint(strings.Replace(sourceStub.server.URL, "http://", "http://user:secret@", 1) + "/owner/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, err := newLfsEndpoint(destStub.server.URL + "/owner/repo.git")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	objects := []lfsObject{{Oid: testLfsOid, Size: 12}, {Oid: presentOid, Size: 8}}
+
+	uploads, err := dest.batch(ctx, "upload", objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := []lfsBatchObject{}
+	for _, upload := range uploads {
+		if _, found := upload.Actions["upload"]; found {
+			missing = append(missing, upload)
+		}
+	}
+
+	if len(missing) != 1 || missing[0].Oid != testLfsOid {
+		t.Fatalf("expected only %s to be missing, got %+v", testLfsOid, missing)
+	}
+
+	downloads, err := source.batch(ctx, "download", []lfsObject{missing[0].lfsObject})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(downloads) != 1 {
+		t.Fatalf("expected one download, got %+v", downloads)
+	}
+
+	err = copyLfsObject(ctx, source, dest, downloads[0].Actions["download"], missing[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contents := destStub.objects[testLfsOid]; contents != "hello world\n" {
+		t.Errorf("expected the object to be uploaded, got %q", contents)
+	}
+
+	if len(destStub.verified) != 1 || destStub.verified[0] != testLfsOid {
+		t.Errorf("expected %s to be verified, got %v", testLfsOid, destStub.verified)
+	}
+
+	if len(sourceStub.authorizations) != 1 || !strings.HasPrefix(sourceStub.authorizations[0], "Basic ") {
+		t.Errorf("expected the source credentials to be sent, got %v", sourceStub.authorizations)
+	}
+}
@@ -0,0 +1,196 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"gitr-backup/constants"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Marker added to the description of orphaned backups, recording since when
+// they are orphaned so the grace period survives across runs
+var orphanMarker = regexp.MustCompile(`\[orphaned ([^\]]*)\]\s*`)
+
+func orphanedSince(desc string) (time.Time, bool) {
+	markers, _ := splitMarkers(desc)
+	match := orphanMarker.FindStringSubmatch(markers)
+	if match == nil {
+		return time.Time{}, false
+	}
+
+	since, err := time.Parse(time.RFC3339, match[1])
+	if err != nil {
+		// Mangled by hand, start the grace period over
+		return time.Now(), true
+	}
+
+	return since, true
+}
+
+func markOrphaned(desc string, since time.Time) string {
+	marker := fmt.Sprintf("[orphaned %s] ", since.UTC().Format(time.RFC3339))
+	rest := strings.TrimSpace(strings.TrimPrefix(clearOrphaned(desc), constants.BACKUP_PREFIX))
+	return truncateDescription(fmt.Sprintf("%s %s%s", constants.BACKUP_PREFIX, marker, rest))
+}
+
+func clearOrphaned(desc string) string {
+	markers, rest := splitMarkers(desc)
+	return orphanMarker.ReplaceAllString(markers, "") + rest
+}
+
+// Apply the orphan policy of the destination to a backup repository whose
+// source is gone
+func (state *syncContext) handleOrphan(logger zerolog.Logger, destination vcs.Vcs, destRepo repository.Repository, result *RepositoryResult) error {
+	policy := destination.GetConfig().Orphans
+	result.Action = ActionOrphaned
+
+	logger = logger.With().Str("policy", policy.Policy).Logger()
+
+	if policy.Policy == "keep" {
+		result.Orphan = "kept"
+		return nil
+	}
+
+	dryRun := state.ctx.Value(constants.DRY_RUN).(bool)
+
+	desc := destRepo.GetDescription()
+	since, marked := orphanedSince(desc)
+	if !marked {
+		since = time.Now()
+
+		if dryRun {
+			logger.Info().Msg("Would mark the repository as orphaned, but dry-run mode is enabled")
+		} else {
+			logger.Info().Msg("Marking repository as orphaned")
+
+			err := destRepo.SetDescription(state.ctx, markOrphaned(desc, since))
+			if err != nil {
+				return err
+			}
+
+			err = destRepo.AddLabel(state.ctx, constants.ORPHANED_LABEL)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if remaining := policy.GracePeriod - time.Since(since); remaining > 0 {
+		logger.Info().Time("since", since).Dur("remaining", remaining).Msg("Orphaned repository in grace period")
+		result.Orphan = "pending"
+		return nil
+	}
+
+	switch policy.Policy {
+	case "archive":
+		archivable, ok := destRepo.(repository.Archivable)
+		if !ok {
+			return errors.New("repositories of this host cannot be archived")
+		}
+
+		result.Orphan = "archived"
+		if archivable.IsArchived() {
+			return nil
+		}
+
+		if dryRun {
+			logger.Info().Msg("Would archive the orphaned repository, but dry-run mode is enabled")
+			return nil
+		}
+
+		logger.Info().Msg("Archiving orphaned repository")
+		return archivable.SetArchived(state.ctx, true)
+	case "rename":
+		renamer, ok := destRepo.(repository.Renamer)
+		if !ok {
+			return errors.New("repositories of this host cannot be renamed")
+		}
+
+		result.Orphan = "renamed"
+		if strings.HasSuffix(destRepo.GetName(), policy.Suffix) {
+			return nil
+		}
+
+		name := destRepo.GetName() + policy.Suffix
+		if dryRun {
+			logger.Info().Str("name", name).Msg("Would rename the orphaned repository, but dry-run mode is enabled")
+			return nil
+		}
+
+		logger.Info().Str("name", name).Msg("Renaming orphaned repository")
+		return renamer.Rename(state.ctx, name)
+	case "delete":
+		deleter, ok := destRepo.(repository.Deleter)
+		if !ok {
+			return errors.New("repositories of this host cannot be deleted")
+		}
+
+		if dryRun {
+			result.Orphan = "deleted"
+			logger.Info().Msg("Would delete the orphaned repository, but dry-run mode is enabled")
+			return nil
+		}
+
+		err := state.claimAffected(logger)
+		if err != nil {
+			result.Orphan = "pending"
+			return err
+		}
+
+		result.Orphan = "deleted"
+
+		logger.Warn().Time("since", since).Msg("Deleting orphaned repository")
+		return deleter.Delete(state.ctx)
+	}
+
+	return fmt.Errorf("unknown orphan policy: %s", policy.Policy)
+}
+
+// Undo the orphan marking of a backup repository whose source is back
+func (state *syncContext) clearOrphan(logger zerolog.Logger, destination vcs.Vcs, destRepo repository.Repository) error {
+	desc := destRepo.GetDescription()
+	if _, marked := orphanedSince(desc); !marked {
+		return nil
+	}
+
+	if state.ctx.Value(constants.DRY_RUN).(bool) {
+		logger.Info().Msg("Would clear the orphaned mark, but dry-run mode is enabled")
+		return nil
+	}
+
+	logger.Info().Msg("Source is back, clearing orphaned mark")
+
+	// Archived repositories are read-only
+	if archivable, ok := destRepo.(repository.Archivable); ok && archivable.IsArchived() {
+		err := archivable.SetArchived(state.ctx, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Renamed repositories get their name back
+	suffix := destination.GetConfig().Orphans.Suffix
+	if renamer, ok := destRepo.(repository.Renamer); ok && suffix != "" {
+		if name, renamed := strings.CutSuffix(destRepo.GetName(), suffix); renamed && name != "" {
+			logger.Info().Str("name", name).Msg("Renaming repository back")
+
+			err := renamer.Rename(state.ctx, name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := destRepo.SetDescription(state.ctx, clearOrphaned(desc))
+	if err != nil {
+		return err
+	}
+
+	return destRepo.RemoveLabel(state.ctx, constants.ORPHANED_LABEL)
+}
@@ -0,0 +1,133 @@
+package sync
+
+import (
+	"context"
+	"gitr-backup/config"
+	"gitr-backup/constants"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Host with only a configuration
+type configuredHost struct {
+	config config.Host
+}
+
+func (host *configuredHost) GetConfig() *config.Host { return &host.config }
+func (host *configuredHost) GetRepositories(ctx context.Context) ([]repository.Repository, error) {
+	return nil, nil
+}
+func (host *configuredHost) GetRepositoryByUrl(ctx context.Context, url string) (*repository.Repository, error) {
+	return nil, vcs.ErrRepositoryNotFound
+}
+func (host *configuredHost) CreateRepository(ctx context.Context, options *vcs.CreateRepositoryOptions) (repository.Repository, error) {
+	return nil, nil
+}
+
+// Repository which can be archived
+type archivableRepository struct {
+	describedRepository
+	archived bool
+}
+
+func (repo *archivableRepository) IsArchived() bool { return repo.archived }
+func (repo *archivableRepository) SetArchived(ctx context.Context, archived bool) error {
+	repo.archived = archived
+	return nil
+}
+
+func TestOrphanedSince(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		desc     string
+		marked   bool
+		expected time.Time
+	}{
+		{"[backup] [orphaned 2024-01-01T00:00:00Z] https://git.example.com/owner/repo", true, since},
+		{"[backup] [ignore] [orphaned 2024-01-01T00:00:00Z] https://git.example.com/owner/repo", true, since},
+		{"[backup] https://git.example.com/owner/repo", false, time.Time{}},
+		{"[backup] https://git.example.com/owner/repo Was [orphaned 2024-01-01T00:00:00Z] once", false, time.Time{}},
+	}
+
+	for _, test := range tests {
+		actual, marked := orphanedSince(test.desc)
+		if marked != test.marked || !actual.Equal(test.expected) {
+			t.Errorf("%q: expected (%v, %v), got (%v, %v)", test.desc, test.expected, test.marked, actual, marked)
+		}
+	}
+
+	// Mangled dates start the grace period over
+	actual, marked := orphanedSince("[backup] [orphaned yesterday] https://git.example.com/owner/repo")
+	if !marked || time.Since(actual) > time.Minute {
+		t.Errorf("mangled date: expected to be marked since now, got (%v, %v)", actual, marked)
+	}
+}
+
+func TestMarkOrphaned(t *testing.T) {
+	const desc = "[backup] https://git.example.com/owner/repo My project"
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	marked := markOrphaned(desc, since)
+	if expected := "[backup] [orphaned 2024-01-01T00:00:00Z] https://git.example.com/owner/repo My project"; marked != expected {
+		t.Errorf("expected %q, got %q", expected, marked)
+	}
+
+	if actual, found := orphanedSince(marked); !found || !actual.Equal(since) {
+		t.Errorf("expected to be orphaned since %v, got (%v, %v)", since, actual, found)
+	}
+
+	// Marking again replaces the date
+	later := since.Add(time.Hour)
+	if actual, _ := orphanedSince(markOrphaned(marked, later)); !actual.Equal(later) {
+		t.Errorf("expected to be orphaned since %v, got %v", later, actual)
+	}
+
+	if cleared := clearOrphaned(marked); cleared != desc {
+		t.Errorf("expected %q, got %q", desc, cleared)
+	}
+}
+
+func TestHandleOrphanGracePeriod(t *testing.T) {
+	const desc = "[backup] https://git.example.com/owner/repo"
+
+	tests := []struct {
+		name     string
+		desc     string
+		archived bool
+		orphan   string
+	}{
+		{"new orphan", desc, false, "pending"},
+		{"in grace period", markOrphaned(desc, time.Now().Add(-time.Hour)), false, "pending"},
+		{"grace period over", markOrphaned(desc, time.Now().Add(-48*time.Hour)), true, "archived"},
+	}
+
+	destination := &configuredHost{config: config.Host{
+		Name:    "backup",
+		Orphans: config.Orphans{Policy: "archive", GracePeriod: 24 * time.Hour},
+	}}
+
+	for _, test := range tests {
+		state := &syncContext{ctx: context.WithValue(context.Background(), constants.DRY_RUN, false)}
+		repo := &archivableRepository{describedRepository: describedRepository{description: test.desc}}
+		result := &RepositoryResult{}
+
+		err := state.handleOrphan(zerolog.Nop(), destination, repo, result)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if result.Orphan != test.orphan || repo.archived != test.archived {
+			t.Errorf("%s: expected (%s, archived %v), got (%s, archived %v)", test.name, test.orphan, test.archived, result.Orphan, repo.archived)
+		}
+
+		if _, marked := orphanedSince(repo.description); !marked {
+			t.Errorf("%s: expected the description to be marked, got %q", test.name, repo.description)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package sync
+
+import (
+	"sync"
+)
+
+type job struct {
+	name string
+	run  func()
+}
+
+// Run jobs on a bounded number of workers. Once done is closed, no new job is
+// started but the running ones are waited for. The names of the jobs which
+// were not started are returned.
+func runPool(done <-chan struct{}, workers int, jobs []job) []string {
+	queue := make(chan job)
+	wg := sync.WaitGroup{}
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+
+			for job := range queue {
+				job.run()
+			}
+		}()
+	}
+
+	skipped := []string{}
+
+queueing:
+	for i, job := range jobs {
+		// Checked first, as select picks randomly when a worker is also ready
+		select {
+		case <-done:
+		default:
+			select {
+			case <-done:
+			case queue <- job:
+				continue queueing
+			}
+		}
+
+		for _, job := range jobs[i:] {
+			skipped = append(skipped, job.name)
+		}
+
+		break
+	}
+
+	close(queue)
+	wg.Wait()
+
+	return skipped
+}
@@ -0,0 +1,169 @@
+package sync
+
+import (
+	"fmt"
+	"gitr-backup/config"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+// Namespace of the refs deleted or rewritten on the source, followed by the
+// time they were preserved and the original ref name without refs/
+const preservedRefsPrefix = internalRefsPrefix + "deleted/"
+
+// Ref names can't contain colons, so RFC3339 is out
+const preservedTimestampFormat = "20060102T150405Z"
+
+func preservedRefName(timestamp, refName string) string {
+	return preservedRefsPrefix + timestamp + "/" + strings.TrimPrefix(refName, "refs/")
+}
+
+// Check whether updating a destination ref to its source value loses commits
+func isRewritten(repo *git.Repository, previous, updated repository.Ref) (bool, error) {
+	// Tags are not supposed to move at all, other refs may fast-forward like
+	// branches
+	if strings.HasPrefix(previous.RefName, "refs/tags/") {
+		return true, nil
+	}
+
+	previousOid, err := git.NewOid(previous.Peeled)
+	if err != nil {
+		return false, err
+	}
+
+	updatedOid, err := git.NewOid(updated.Peeled)
+	if err != nil {
+		return false, err
+	}
+
+	fastForward, err := repo.DescendantOf(updatedOid, previousOid)
+	if git.IsErrorCode(err, git.ErrorCodeNotFound) {
+		// The previous commit is not reachable from the source anymore
+		return true, nil
+	}
+
+	return !fastForward, err
+}
+
+// Get the destination refs which an update rewrites, given a local copy of
+// the source
+func rewrittenRefs(repo *git.Repository, changelog RefdiffResult) ([]repository.Ref, error) {
+	changedRefs := refmapFromList(changelog.ChangedRefs)
+	rewritten := []repository.Ref{}
+
+	for _, ref := range changelog.ReplacedRefs {
+		isRewrite, err := isRewritten(repo, ref, changedRefs[ref.RefName])
+		if err != nil {
+			return nil, fmt.Errorf("failed checking history of %s: %w", ref.RefName, err)
+		}
+
+		if isRewrite {
+			rewritten = append(rewritten, ref)
+		}
+	}
+
+	return rewritten, nil
+}
+
+// Copy destination refs under the preserved namespace, returning the refspecs
+// pushing them back. They are fetched from the destination, since their
+// commits may be gone from the source.
+func preserveRefs(logger zerolog.Logger, remote *git.Remote, refs []repository.Ref, timestamp string) ([]string, error) {
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	fetchRefspecs := []string{}
+	refspecs := []string{}
+	for _, ref := range refs {
+		name := preservedRefName(timestamp, ref.RefName)
+		logger.Info().Str("refname", ref.RefName).Str("sha", ref.Sha).Str("as", name).Msg("Preserving ref")
+
+		fetchRefspecs = append(fetchRefspecs, fmt.Sprintf("+%s:%s", ref.RefName, name))
+		refspecs = append(refspecs, fmt.Sprintf("+%s:%s", name, name))
+	}
+
+	err := remote.Fetch(fetchRefspecs, &git.FetchOptions{
+		RemoteCallbacks: git.RemoteCallbacks{
+			CredentialsCallback: vcs.CredentialsCallback,
+		},
+	}, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed fetching refs to preserve: %w", err)
+	}
+
+	return refspecs, nil
+}
+
+// Get the refspecs deleting the preserved refs which are beyond the retention
+// settings, counting the ones being preserved now if any
+func expirePreservedRefs(logger zerolog.Logger, remote *git.Remote, protection config.Protection, now time.Time, preserving bool) ([]string, error) {
+	if protection.MaxAge == 0 && protection.MaxSnapshots == 0 {
+		return nil, nil
+	}
+
+	err := remote.ConnectFetch(&git.RemoteCallbacks{
+		CredentialsCallback: vcs.CredentialsCallback,
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Disconnect()
+
+	heads, err := remote.Ls()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := map[string][]string{}
+	for _, head := range heads {
+		rest, found := strings.CutPrefix(head.Name, preservedRefsPrefix)
+		if !found || strings.HasSuffix(rest, "^{}") {
+			continue
+		}
+
+		timestamp, _, _ := strings.Cut(rest, "/")
+		snapshots[timestamp] = append(snapshots[timestamp], head.Name)
+	}
+
+	// The timestamp format sorts chronologically
+	timestamps := []string{}
+	for timestamp := range snapshots {
+		timestamps = append(timestamps, timestamp)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(timestamps)))
+
+	kept := 0
+	if preserving {
+		kept = 1
+	}
+
+	refspecs := []string{}
+	for _, timestamp := range timestamps {
+		preservedAt, err := time.Parse(preservedTimestampFormat, timestamp)
+		if err != nil {
+			// Not ours, leave it alone
+			continue
+		}
+
+		if (protection.MaxAge > 0 && now.Sub(preservedAt) > protection.MaxAge) ||
+			(protection.MaxSnapshots > 0 && kept >= protection.MaxSnapshots) {
+			logger.Info().Str("timestamp", timestamp).Int("refs", len(snapshots[timestamp])).Msg("Expiring preserved refs")
+			for _, name := range snapshots[timestamp] {
+				refspecs = append(refspecs, fmt.Sprintf("+:%s", name))
+			}
+			continue
+		}
+
+		kept += 1
+	}
+
+	return refspecs, nil
+}
@@ -1,15 +1,27 @@
 package sync
 
-import "gitr-backup/vcs/repository"
+import (
+	"gitr-backup/vcs/repository"
+	"strings"
+)
+
+// Refs written by gitr-backup itself, which are never mirrored
+const internalRefsPrefix = "refs/gitr-backup/"
 
 type RefdiffResult struct {
 	ChangedRefs []repository.Ref
 	DeletedRefs []repository.Ref
+	// Previous value of the changed refs which exist in the destination
+	ReplacedRefs []repository.Ref
 }
 
 func refmapFromList(refs []repository.Ref) map[string]repository.Ref {
 	result := map[string]repository.Ref{}
 	for _, val := range refs {
+		if strings.HasPrefix(val.RefName, internalRefsPrefix) {
+			continue
+		}
+
 		result[val.RefName] = val
 	}
 	return result
@@ -23,10 +35,22 @@ func listFromRefmap(refs map[string]repository.Ref) []repository.Ref {
 	return result
 }
 
+// Compare the objects the refs point to, so an annotated tag recreated on the
+// same commit is seen as changed. Listings missing the objects only have the
+// commits to compare.
+func sameTarget(a, b repository.Ref) bool {
+	if a.Sha == "" || b.Sha == "" {
+		return a.Peeled == b.Peeled
+	}
+
+	return a.Sha == b.Sha
+}
+
 func FullRefdiff(refs []repository.Ref) RefdiffResult {
 	return RefdiffResult{
-		ChangedRefs: refs,
-		DeletedRefs: []repository.Ref{},
+		ChangedRefs:  refs,
+		DeletedRefs:  []repository.Ref{},
+		ReplacedRefs: []repository.Ref{},
 	}
 }
 
@@ -37,6 +61,7 @@ func Refdiff(sourceRefs, destRefs []repository.Ref) RefdiffResult {
 
 	changedRefs := map[string]repository.Ref{}
 	deletedRefs := map[string]repository.Ref{}
+	replacedRefs := map[string]repository.Ref{}
 
 	for _, dref := range drefs {
 		if _, ok := srefs[dref.RefName]; !ok {
@@ -46,14 +71,19 @@ func Refdiff(sourceRefs, destRefs []repository.Ref) RefdiffResult {
 
 	for _, sref := range srefs {
 		dref, ok := drefs[sref.RefName]
-		if !ok || dref.Sha != sref.Sha {
+		if !ok || !sameTarget(dref, sref) {
 			changedRefs[sref.RefName] = sref
 		}
+
+		if ok && !sameTarget(dref, sref) {
+			replacedRefs[dref.RefName] = dref
+		}
 	}
 
 	return RefdiffResult{
-		ChangedRefs: listFromRefmap(changedRefs),
-		DeletedRefs: listFromRefmap(deletedRefs),
+		ChangedRefs:  listFromRefmap(changedRefs),
+		DeletedRefs:  listFromRefmap(deletedRefs),
+		ReplacedRefs: listFromRefmap(replacedRefs),
 	}
 }
 
@@ -0,0 +1,133 @@
+package sync
+
+import (
+	"gitr-backup/vcs/repository"
+	"slices"
+	"testing"
+)
+
+const (
+	commitA = "1111111111111111111111111111111111111111"
+	commitB = "2222222222222222222222222222222222222222"
+	tagA    = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	tagB    = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func tagRef(sha, peeled string) repository.Ref {
+	return repository.Ref{Name: "v1", Sha: sha, Peeled: peeled, RefName: "refs/tags/v1"}
+}
+
+func refNames(refs []repository.Ref) []string {
+	names := []string{}
+	for _, ref := range refs {
+		names = append(names, ref.RefName)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+func TestSameTarget(t *testing.T) {
+	tests := []struct {
+		name     string
+		a, b     repository.Ref
+		expected bool
+	}{
+		{"lightweight tag", tagRef(commitA, commitA), tagRef(commitA, commitA), true},
+		{"moved lightweight tag", tagRef(commitA, commitA), tagRef(commitB, commitB), false},
+		{"annotated tag", tagRef(tagA, commitA), tagRef(tagA, commitA), true},
+		{"annotated tag recreated on the same commit", tagRef(tagA, commitA), tagRef(tagB, commitA), false},
+		{"annotated tag replaced by a lightweight one", tagRef(tagA, commitA), tagRef(commitA, commitA), false},
+		{"listing without objects", tagRef("", commitA), tagRef(tagA, commitA), true},
+		{"listing without objects, moved", tagRef(tagA, commitA), tagRef("", commitB), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := sameTarget(test.a, test.b); same != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, same)
+			}
+		})
+	}
+}
+
+func TestRefdiff(t *testing.T) {
+	main := repository.Ref{Name: "main", Sha: commitA, Peeled: commitA, RefName: "refs/heads/main"}
+	preserved := repository.Ref{Name: "preserved", Sha: commitA, Peeled: commitA, RefName: preservedRefName("20240102T030405Z", "refs/heads/old")}
+
+	tests := []struct {
+		name     string
+		source   []repository.Ref
+		dest     []repository.Ref
+		changed  []string
+		deleted  []string
+		replaced []string
+	}{
+		{
+			name:     "unchanged lightweight tag",
+			source:   []repository.Ref{main, tagRef(commitA, commitA)},
+			dest:     []repository.Ref{main, tagRef(commitA, commitA)},
+			changed:  []string{},
+			deleted:  []string{},
+			replaced: []string{},
+		},
+		{
+			name:     "unchanged annotated tag",
+			source:   []repository.Ref{tagRef(tagA, commitA)},
+			dest:     []repository.Ref{tagRef(tagA, commitA)},
+			changed:  []string{},
+			deleted:  []string{},
+			replaced: []string{},
+		},
+		{
+			name:     "annotated tag recreated on the same commit",
+			source:   []repository.Ref{tagRef(tagB, commitA)},
+			dest:     []repository.Ref{tagRef(tagA, commitA)},
+			changed:  []string{"refs/tags/v1"},
+			deleted:  []string{},
+			replaced: []string{"refs/tags/v1"},
+		},
+		{
+			name:     "destination listed without objects",
+			source:   []repository.Ref{tagRef(tagA, commitA)},
+			dest:     []repository.Ref{tagRef("", commitA)},
+			changed:  []string{},
+			deleted:  []string{},
+			replaced: []string{},
+		},
+		{
+			name:     "new and deleted refs",
+			source:   []repository.Ref{tagRef(tagA, commitA)},
+			dest:     []repository.Ref{main},
+			changed:  []string{"refs/tags/v1"},
+			deleted:  []string{"refs/heads/main"},
+			replaced: []string{},
+		},
+		{
+			name:     "internal refs",
+			source:   []repository.Ref{main},
+			dest:     []repository.Ref{main, preserved},
+			changed:  []string{},
+			deleted:  []string{},
+			replaced: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := Refdiff(test.source, test.dest)
+
+			if names := refNames(result.ChangedRefs); !slices.Equal(names, test.changed) {
+				t.Errorf("changed refs: expected %v, got %v", test.changed, names)
+			}
+
+			if names := refNames(result.DeletedRefs); !slices.Equal(names, test.deleted) {
+				t.Errorf("deleted refs: expected %v, got %v", test.deleted, names)
+			}
+
+			if names := refNames(result.ReplacedRefs); !slices.Equal(names, test.replaced) {
+				t.Errorf("replaced refs: expected %v, got %v", test.replaced, names)
+			}
+		})
+	}
+}
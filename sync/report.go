@@ -0,0 +1,282 @@
+package sync
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Action string
+
+const (
+	ActionCreated   Action = "created"
+	ActionUpdated   Action = "updated"
+	ActionUnchanged Action = "unchanged"
+	ActionIgnored   Action = "ignored"
+	ActionOrphaned  Action = "orphaned"
+	ActionFailed    Action = "failed"
+	// Refused for losing too much data, until forced
+	ActionBlocked Action = "blocked"
+	// Not processed because the run was interrupted
+	ActionSkipped Action = "skipped"
+)
+
+var ReportFormats = []string{"json", "junit", "markdown"}
+
+type RepositoryResult struct {
+	Name   string `json:"name"`
+	Source string `json:"source,omitempty"`
+	Action Action `json:"action"`
+	// Outcome of the orphan policy: kept, pending, archived, renamed or
+	// deleted
+	Orphan           string        `json:"orphan,omitempty"`
+	ChangedRefs      int           `json:"changed_refs"`
+	DeletedRefs      int           `json:"deleted_refs"`
+	PreservedRefs    int           `json:"preserved_refs"`
+	LfsObjects       int           `json:"lfs_objects"`
+	WikiRefs         int           `json:"wiki_refs"`
+	WikiError        string        `json:"wiki_error,omitempty"`
+	BytesTransferred uint64        `json:"bytes_transferred"`
+	Duration         time.Duration `json:"duration_ns"`
+	Error            string        `json:"error,omitempty"`
+}
+
+type DestinationResult struct {
+	Name         string              `json:"name"`
+	Error        string              `json:"error,omitempty"`
+	Repositories []*RepositoryResult `json:"repositories"`
+	mtx          sync.Mutex
+}
+
+type Report struct {
+	StartedAt    time.Time            `json:"started_at"`
+	Duration     time.Duration        `json:"duration_ns"`
+	DryRun       bool                 `json:"dry_run"`
+	Destinations []*DestinationResult `json:"destinations"`
+}
+
+func (dest *DestinationResult) add(result *RepositoryResult) {
+	dest.mtx.Lock()
+	dest.Repositories = append(dest.Repositories, result)
+	dest.mtx.Unlock()
+}
+
+func (dest *DestinationResult) count(action Action) int {
+	count := 0
+	for _, repo := range dest.Repositories {
+		if repo.Action == action {
+			count += 1
+		}
+	}
+
+	return count
+}
+
+func (repo *RepositoryResult) describeAction() string {
+	if repo.Orphan != "" {
+		return fmt.Sprintf("%s (%s)", repo.Action, repo.Orphan)
+	}
+
+	return string(repo.Action)
+}
+
+func (report *Report) writeJson(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Name    string           `xml:"name,attr"`
+	Time    float64          `xml:"time,attr"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+func (report *Report) writeJunit(w io.Writer) error {
+	suites := junitTestSuites{Name: "gitr-backup", Time: report.Duration.Seconds()}
+
+	for _, dest := range report.Destinations {
+		suite := junitTestSuite{
+			Name:      dest.Name,
+			Tests:     len(dest.Repositories),
+			Failures:  dest.count(ActionFailed),
+			Skipped:   dest.count(ActionSkipped) + dest.count(ActionIgnored),
+			Timestamp: report.StartedAt.Format(time.RFC3339),
+		}
+
+		if dest.Error != "" {
+			suite.Errors = 1
+		}
+
+		for _, repo := range dest.Repositories {
+			suite.Time += repo.Duration.Seconds()
+
+			testCase := junitTestCase{
+				Name:      repo.Name,
+				ClassName: dest.Name,
+				Time:      repo.Duration.Seconds(),
+				SystemOut: fmt.Sprintf("action: %s\nsource: %s\nchanged refs: %d\ndeleted refs: %d\npreserved refs: %d\nlfs objects: %d\nwiki refs: %d\nbytes transferred: %d",
+					repo.describeAction(), repo.Source, repo.ChangedRefs, repo.DeletedRefs, repo.PreservedRefs, repo.LfsObjects, repo.WikiRefs, repo.BytesTransferred),
+			}
+
+			if repo.WikiError != "" {
+				testCase.SystemOut += "\nwiki error: " + repo.WikiError
+			}
+
+			switch repo.Action {
+			case ActionFailed, ActionBlocked:
+				testCase.Failure = &junitFailure{Message: repo.Error, Text: repo.Error}
+			case ActionSkipped, ActionIgnored:
+				testCase.Skipped = &struct{}{}
+			}
+
+			suite.TestCases = append(suite.TestCases, testCase)
+		}
+
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(&suites)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func formatBytes(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(bytes)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit += 1
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func (report *Report) writeMarkdown(w io.Writer) error {
+	var out strings.Builder
+
+	fmt.Fprintf(&out, "# Backup report\n\nStarted at %s, took %s.", report.StartedAt.Format(time.RFC3339), report.Duration.Round(time.Second))
+	if report.DryRun {
+		out.WriteString(" Dry-run mode was enabled, nothing was changed.")
+	}
+	out.WriteString("\n")
+
+	// Table cells can't contain newlines or unescaped pipes
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+
+	for _, dest := range report.Destinations {
+		fmt.Fprintf(&out, "\n## %s\n\n", dest.Name)
+
+		if dest.Error != "" {
+			fmt.Fprintf(&out, "**Error:** %s\n\n", escape.Replace(dest.Error))
+		}
+
+		summary := []string{}
+		for _, action := range []Action{ActionCreated, ActionUpdated, ActionUnchanged, ActionIgnored, ActionOrphaned, ActionFailed, ActionBlocked, ActionSkipped} {
+			if count := dest.count(action); count > 0 {
+				summary = append(summary, fmt.Sprintf("%d %s", count, action))
+			}
+		}
+
+		if len(summary) == 0 {
+			out.WriteString("No repositories.\n")
+			continue
+		}
+
+		fmt.Fprintf(&out, "%s.\n\n", strings.Join(summary, ", "))
+		out.WriteString("| Repository | Action | Changed refs | Deleted refs | Preserved refs | Transferred | Duration | Error |\n")
+		out.WriteString("|---|---|---:|---:|---:|---:|---:|---|\n")
+
+		for _, repo := range dest.Repositories {
+			errorText := repo.Error
+			if repo.WikiError != "" {
+				errorText = strings.TrimSpace(errorText + " wiki: " + repo.WikiError)
+			}
+
+			fmt.Fprintf(&out, "| %s | %s | %d | %d | %d | %s | %s | %s |\n",
+				escape.Replace(repo.Name),
+				repo.describeAction(),
+				repo.ChangedRefs,
+				repo.DeletedRefs,
+				repo.PreservedRefs,
+				formatBytes(repo.BytesTransferred),
+				repo.Duration.Round(time.Millisecond),
+				escape.Replace(errorText))
+		}
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// Write the report to a file, in one of the ReportFormats
+func (report *Report) Write(path, format string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "json":
+		err = report.writeJson(file)
+	case "junit":
+		err = report.writeJunit(file)
+	case "markdown":
+		err = report.writeMarkdown(file)
+	default:
+		err = fmt.Errorf("unknown report format: %s", format)
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
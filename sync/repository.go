@@ -2,13 +2,19 @@ package sync
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"gitr-backup/config"
 	"gitr-backup/constants"
+	"gitr-backup/metrics"
 	"gitr-backup/vcs"
 	"gitr-backup/vcs/repository"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 
@@ -23,6 +29,8 @@ type repositorySource struct {
 type repositoryState struct {
 	isBackup bool
 	ignore   bool
+	// Backup of the wiki of its source url
+	isWiki bool
 }
 
 func createMirrorRemote(repo *git.Repository, name, url string) (*git.Remote, error) {
@@ -47,30 +55,90 @@ func safeUrl(rawUrl string) string {
 	return parsed.String()
 }
 
+// Maximum length of backup descriptions, GitHub being the most restrictive
+const maxDescriptionLength = 350
+
+// Markers are removed from source descriptions, they only have a meaning in
+// front of the url of backups
+var markerRemover = strings.NewReplacer(constants.BACKUP_PREFIX, "", constants.IGNORE_PREFIX, "", constants.WIKI_PREFIX, "")
+
+// Build the description of a backup repository. The source description is
+// kept after the url so it can be restored.
+func backupDescription(sourceRepo repository.Repository) string {
+	desc := fmt.Sprintf("%s %s", constants.BACKUP_PREFIX, sourceRepo.GetUrl())
+	if vcs.IsWiki(sourceRepo) {
+		desc = fmt.Sprintf("%s %s %s", constants.BACKUP_PREFIX, constants.WIKI_PREFIX, sourceRepo.GetUrl())
+	}
+	if sourceDesc := strings.TrimSpace(markerRemover.Replace(sourceRepo.GetDescription())); sourceDesc != "" {
+		desc = fmt.Sprintf("%s %s", desc, sourceDesc)
+	}
+
+	return truncateDescription(desc)
+}
+
+func truncateDescription(desc string) string {
+	if runes := []rune(desc); len(runes) > maxDescriptionLength {
+		desc = string(runes[:maxDescriptionLength])
+	}
+
+	return desc
+}
+
+// One of the markers which start the description of a backup repository
+var leadingMarker = regexp.MustCompile(`^(?:` + regexp.QuoteMeta(constants.BACKUP_PREFIX) + `|` + regexp.QuoteMeta(constants.IGNORE_PREFIX) + `|` + regexp.QuoteMeta(constants.WIKI_PREFIX) + `|` + orphanMarker.String() + `)\s*`)
+
+// Split the description of a repository into its leading markers and the
+// rest. Markers are only recognized there, so a source description kept after
+// the url can't set any.
+func splitMarkers(desc string) (string, string) {
+	end := 0
+	for {
+		loc := leadingMarker.FindStringIndex(desc[end:])
+		if loc == nil {
+			return desc[:end], desc[end:]
+		}
+
+		end += loc[1]
+	}
+}
+
+// Get the state of a repository from the markers of its description. Backups
+// are the repositories whose description starts with the backup marker.
+func parseRepositoryState(desc string) repositoryState {
+	markers, _ := splitMarkers(desc)
+
+	return repositoryState{
+		isBackup: strings.HasPrefix(desc, constants.BACKUP_PREFIX),
+		ignore:   strings.Contains(markers, constants.IGNORE_PREFIX),
+		isWiki:   strings.Contains(markers, constants.WIKI_PREFIX),
+	}
+}
+
+// Extract the source url and the original description from the description
+// of a backup repository.
+func parseBackupDescription(desc string) (string, string) {
+	_, rest := splitMarkers(desc)
+
+	sourceUrl, sourceDesc, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	return sourceUrl, strings.TrimSpace(sourceDesc)
+}
+
 func (syncCtx *syncContext) findRepositorySource(logger zerolog.Logger, repository repository.Repository) (*repositorySource, repositoryState, error) {
 	// Ensure labels are set correctly
 	desc := repository.GetDescription()
-
-	state := repositoryState{
-		isBackup: strings.Contains(desc, constants.BACKUP_PREFIX),
-		ignore:   strings.Contains(desc, constants.IGNORE_PREFIX),
-	}
+	state := parseRepositoryState(desc)
 
 	if state.isBackup {
-		sourceUrl := strings.TrimSpace(strings.ReplaceAll(strings.ReplaceAll(desc, constants.BACKUP_PREFIX, ""), constants.IGNORE_PREFIX, ""))
+		sourceUrl, _ := parseBackupDescription(desc)
 
 		sourceLogger := logger.With().Str("source", sourceUrl).Logger()
 		if sourceUrl != "" {
-			// Try parsing url
-			parsedUrl, err := url.Parse(sourceUrl)
+			// Try matching the url with a source host
+			host, err := syncCtx.findSourceHost(sourceUrl)
 			if err != nil {
 				sourceLogger.Warn().Err(err).Msg("Failed parsing URL for repository")
 			} else {
-				parsedUrl.Path = ""
-				urlStr := parsedUrl.String()
-
-				host, found := syncCtx.sourcesByPrefix[urlStr]
-				if found {
+				if host != nil {
 					sourceLogger.Info().Str("source_host", host.GetConfig().Name).Msg("Found backup repository")
 
 					syncCtx.mtx.Lock()
@@ -103,8 +171,7 @@ func (syncCtx *syncContext) findRepositorySource(logger zerolog.Logger, reposito
 
 func (state *syncContext) ensureLabel(logger zerolog.Logger, repository repository.Repository, isBackup bool) error {
 	// Ensure labels are set correctly
-	desc := repository.GetDescription()
-	if strings.HasPrefix(desc, constants.BACKUP_PREFIX) {
+	if isBackup {
 		err := repository.AddLabel(state.ctx, constants.BACKUP_LABEL)
 		if err != nil {
 			return err
@@ -130,40 +197,154 @@ func (state *syncContext) ensureLabel(logger zerolog.Logger, repository reposito
 	return nil
 }
 
-func mirrorRefs(ctx context.Context, logger zerolog.Logger, sourceRepo, destRepo repository.Repository, changelog RefdiffResult) error {
-	// Clone the remote repository
+// Clone the source repository in a temporary directory, removed by the
+// returned cleanup function
+func cloneTemporary(logger zerolog.Logger, sourceRepo repository.Repository, progress git.TransferProgressCallback) (*git.Repository, string, func(), error) {
 	dir, err := os.MkdirTemp("", "gitr-backup")
 	if err != nil {
-		return err
+		return nil, "", nil, err
 	}
-	defer os.RemoveAll(dir)
 
 	// https://github.com/libgit2/pygit2/blob/acb4abbcb2ac7d59961ede6c6be2c43782f22f63/docs/recipes/git-clone-mirror.rst
 	options := &git.CloneOptions{
 		Bare:                 true,
 		RemoteCreateCallback: createMirrorRemote,
+		FetchOptions: git.FetchOptions{
+			RemoteCallbacks: git.RemoteCallbacks{
+				CredentialsCallback:      vcs.CredentialsCallback,
+				TransferProgressCallback: progress,
+			},
+		},
 	}
 
 	sourceCloneUrl, err := sourceRepo.GetHttpsCloneUrl()
 	if err != nil {
-		return err
+		os.RemoveAll(dir)
+		return nil, "", nil, err
 	}
 
 	logger.Info().Str("path", dir).Str("clone_url", safeUrl(sourceCloneUrl)).Msg("Cloning source repository")
 	cloned, err := git.Clone(sourceCloneUrl, dir, options)
 	if err != nil {
-		return err
+		os.RemoveAll(dir)
+		return nil, "", nil, err
+	}
+
+	return cloned, dir, func() {
+		cloned.Free()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+type mirrorOptions struct {
+	// Preserve the refs deleted or rewritten on the source, if enabled
+	protection config.Protection
+	// Called with the refs rewritten by the update, before it is applied
+	checkRewrites func(rewritten []repository.Ref) error
+	lfs           config.Lfs
+	// Refs of the destination, whose history has its LFS objects already
+	destRefs []repository.Ref
+}
+
+type mirrorStats struct {
+	// Bytes fetched and pushed
+	bytes         uint64
+	preservedRefs int
+	lfsObjects    int
+}
+
+// Mirror the changed refs from the source to the destination
+func mirrorRefs(ctx context.Context, logger zerolog.Logger, sourceRepo, destRepo repository.Repository, changelog RefdiffResult, options mirrorOptions) (mirrorStats, error) {
+	var cloned *git.Repository
+	var dir string
+	var fetchedBytes, pushedBytes uint64
+	stats := mirrorStats{}
+
+	// Get a local copy of the source, from the cache if there is one
+	cacheDir, _ := ctx.Value(constants.CACHE_DIR).(string)
+	if cacheDir != "" {
+		mirror, err := openCachedMirror(ctx, logger, cacheDir, sourceRepo)
+		if err != nil {
+			return stats, fmt.Errorf("failed updating cached mirror: %w", err)
+		}
+		defer mirror.Release()
+
+		cloned, dir = mirror.repo, mirror.path
+		fetchedBytes = mirror.fetchedBytes
+	} else {
+		var cleanup func()
+		var err error
+
+		cloned, dir, cleanup, err = cloneTemporary(logger, sourceRepo, func(progress git.TransferProgress) error {
+			fetchedBytes = uint64(progress.ReceivedBytes)
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		defer cleanup()
+	}
+
+	metrics.TransferredBytes.WithLabelValues("fetch").Add(float64(fetchedBytes))
+	stats.bytes = fetchedBytes
+
+	rewritten, err := rewrittenRefs(cloned, changelog)
+	if err != nil {
+		return stats, err
+	}
+
+	if options.checkRewrites != nil {
+		err = options.checkRewrites(rewritten)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	// Destinations storing snapshots don't receive pushes
+	if archiver, ok := destRepo.(repository.Archiver); ok {
+		err := archiver.Archive(ctx, dir, changelog.ChangedRefs, changelog.DeletedRefs)
+		if err != nil {
+			return stats, err
+		}
+
+		return stats, updateDefaultBranch(ctx, logger, sourceRepo, destRepo)
 	}
 
 	// Switch to the destination remote
 	destCloneUrl, err := destRepo.GetHttpsCloneUrl()
 	if err != nil {
-		return err
+		return stats, err
 	}
 
-	// Compute refspec to push
+	// The remote is not saved, so cached mirrors don't keep the destination
+	// credentials around
+	remote, err := cloned.Remotes.CreateAnonymous(destCloneUrl)
+	if err != nil {
+		return stats, err
+	}
+	defer remote.Free()
+
+	// Compute refspec to push, starting with the refs to preserve so they are
+	// saved before the originals are lost
 	refspecs := []string{}
 
+	if options.protection.Enabled {
+		timestamp := time.Now().UTC().Format(preservedTimestampFormat)
+		preserved, err := preserveRefs(logger, remote, slices.Concat(changelog.DeletedRefs, rewritten), timestamp)
+		if err != nil {
+			return stats, err
+		}
+
+		expired, err := expirePreservedRefs(logger, remote, options.protection, time.Now(), len(preserved) > 0)
+		if err != nil {
+			return stats, fmt.Errorf("failed listing preserved refs: %w", err)
+		}
+
+		stats.preservedRefs = len(preserved)
+		refspecs = append(refspecs, preserved...)
+		refspecs = append(refspecs, expired...)
+	}
+
 	for _, k := range changelog.ChangedRefs {
 		refspecs = append(refspecs, fmt.Sprintf("+%s:%s", k.RefName, k.RefName))
 	}
@@ -172,16 +353,27 @@ func mirrorRefs(ctx context.Context, logger zerolog.Logger, sourceRepo, destRepo
 		refspecs = append(refspecs, fmt.Sprintf("+:%s", k.RefName))
 	}
 
+	// LFS objects are uploaded before the pointers to them, like git-lfs does
+	if options.lfs.Enabled {
+		sourceCloneUrl, err := sourceRepo.GetHttpsCloneUrl()
+		if err != nil {
+			return stats, err
+		}
+
+		lfsObjects, lfsBytes, err := mirrorLfsObjects(ctx, logger, cloned, sourceCloneUrl, destCloneUrl, changelog, options.destRefs, options.lfs)
+		stats.lfsObjects = lfsObjects
+		// Objects are downloaded, then uploaded
+		stats.bytes += 2 * lfsBytes
+		if err != nil {
+			return stats, fmt.Errorf("failed mirroring LFS objects: %w", err)
+		}
+	}
+
 	logger.Info().
 		Str("clone_url", safeUrl(destCloneUrl)).
 		Any("refspecs", refspecs).
 		Msg("Pushing to destination remote")
 
-	remote, err := cloned.Remotes.Create("backup", destCloneUrl)
-	if err != nil {
-		return err
-	}
-
 	// Don't push all refspecs at once
 	rs := 100
 	for i := 0; i < len(refspecs); i += rs {
@@ -191,25 +383,48 @@ func mirrorRefs(ctx context.Context, logger zerolog.Logger, sourceRepo, destRepo
 		}
 
 		window := refspecs[i:j]
+		var windowBytes uint
 		err = remote.Push(window, &git.PushOptions{
 			RemoteCallbacks: git.RemoteCallbacks{
+				CredentialsCallback: vcs.CredentialsCallback,
 				PushUpdateReferenceCallback: func(refname, status string) error {
 					logger.Info().Str("refname", refname).Msgf("Updated ref")
 					return nil
 				},
 				PushTransferProgressCallback: func(current, total uint32, bytes uint) error {
 					logger.Info().Msgf("Progress: %d/%d", current, total)
+					windowBytes = bytes
 					return nil
 				},
 			},
 		})
+		pushedBytes += uint64(windowBytes)
+		stats.bytes = fetchedBytes + pushedBytes
+		metrics.TransferredBytes.WithLabelValues("push").Add(float64(windowBytes))
 		if err != nil {
-			return err
+			return stats, err
 		}
 	}
 
-	expected := sourceRepo.GetDefaultBranch()
-	actual := destRepo.GetDefaultBranch()
+	return stats, updateDefaultBranch(ctx, logger, sourceRepo, destRepo)
+}
+
+func updateDefaultBranch(ctx context.Context, logger zerolog.Logger, sourceRepo, destRepo repository.Repository) error {
+	expected, err := vcs.GetDefaultBranch(ctx, sourceRepo)
+	if err != nil {
+		return err
+	}
+
+	// Nothing to update to if the source doesn't tell
+	if expected == "" {
+		return nil
+	}
+
+	actual, err := vcs.GetDefaultBranch(ctx, destRepo)
+	if err != nil {
+		return err
+	}
+
 	if actual != expected {
 		logger.Info().Str("from", actual).Str("to", expected).Msg("Updating default branch")
 
@@ -222,7 +437,10 @@ func mirrorRefs(ctx context.Context, logger zerolog.Logger, sourceRepo, destRepo
 	return nil
 }
 
-func (state *syncContext) backupNewRepo(logger zerolog.Logger, dest vcs.Vcs, sourceRepo repository.Repository) error {
+func (state *syncContext) backupNewRepo(logger zerolog.Logger, source, dest vcs.Vcs, sourceRepo repository.Repository, result *RepositoryResult) error {
+	result.Action = ActionCreated
+	result.Source = sourceRepo.GetUrl()
+
 	// Check the dry-run flag
 	dryRun := state.ctx.Value(constants.DRY_RUN).(bool)
 	if dryRun {
@@ -233,12 +451,14 @@ func (state *syncContext) backupNewRepo(logger zerolog.Logger, dest vcs.Vcs, sou
 	// Create the target repository
 	destRepo, err := dest.CreateRepository(state.ctx, &vcs.CreateRepositoryOptions{
 		Name:        sourceRepo.GetName(),
-		Description: fmt.Sprintf("%s %s", constants.BACKUP_PREFIX, sourceRepo.GetUrl()),
+		Description: backupDescription(sourceRepo),
 	})
 	if err != nil {
 		return fmt.Errorf("failed creating repository: %w", err)
 	}
 
+	state.indexBackup(dest, sourceRepo.GetUrl(), destRepo)
+
 	// Add tags to the repository
 	err = state.ensureLabel(logger, destRepo, true)
 	if err != nil {
@@ -246,16 +466,34 @@ func (state *syncContext) backupNewRepo(logger zerolog.Logger, dest vcs.Vcs, sou
 	}
 
 	// Get all the refs in the source repo
-	sourceRefs, err := sourceRepo.ListRefs(state.ctx)
+	sourceRefs, err := vcs.ListMatchingRefs(state.ctx, source, sourceRepo, source.GetConfig().Refs)
 	if err != nil {
 		return fmt.Errorf("failed getting source refs: %w", err)
 	}
 
+	result.ChangedRefs = len(sourceRefs)
+
+	release, err := state.transfers.acquire(state.ctx, source, dest)
+	if err != nil {
+		return err
+	}
+
 	// Clone the source to the destination
-	return mirrorRefs(state.ctx, logger, sourceRepo, destRepo, FullRefdiff(sourceRefs))
+	stats, err := mirrorRefs(state.ctx, logger, sourceRepo, destRepo, FullRefdiff(sourceRefs), mirrorOptions{lfs: dest.GetConfig().Lfs})
+	release()
+	result.BytesTransferred = stats.bytes
+	result.LfsObjects = stats.lfsObjects
+	if err != nil {
+		return err
+	}
+
+	metrics.RefsChanged.WithLabelValues(dest.GetConfig().Name, destRepo.GetName(), "updated").Add(float64(result.ChangedRefs))
+
+	state.mirrorWiki(logger, source, dest, sourceRepo, destRepo, result)
+	return nil
 }
 
-func (syncCtx *syncContext) processRepo(logger zerolog.Logger, destRepo repository.Repository) error {
+func (syncCtx *syncContext) processRepo(logger zerolog.Logger, destination vcs.Vcs, destRepo repository.Repository, result *RepositoryResult) error {
 	// Identify the repository source
 	source, state, err := syncCtx.findRepositorySource(logger, destRepo)
 	if err != nil {
@@ -268,44 +506,98 @@ func (syncCtx *syncContext) processRepo(logger zerolog.Logger, destRepo reposito
 		return err
 	}
 
-	// If we have no source or source host, just ignore it
-	if source == nil || source.host == nil {
-		return nil
+	if source != nil {
+		result.Source = source.source
 	}
 
 	// If this repository is explicitely ignored, ignore it
 	if state.ignore {
+		result.Action = ActionIgnored
 		return nil
 	}
 
+	// Backups without a source url are reported, but there is no telling
+	// where they come from
+	if source == nil {
+		if state.isBackup {
+			result.Action = ActionOrphaned
+		}
+
+		return nil
+	}
+
+	// The source host was removed from the configuration
+	if source.host == nil {
+		return syncCtx.handleOrphan(logger, destination, destRepo, result)
+	}
+
 	// Try getting the source repository from the host
-	sourceRepo, err := source.host.GetRepositoryByUrl(syncCtx.ctx, source.source)
-	if err != nil {
+	sourceRepo, err := getSourceRepository(syncCtx.ctx, source.host, source.source, state.isWiki)
+	if errors.Is(err, vcs.ErrRepositoryNotFound) {
+		logger.Warn().Msg("Source repository not found")
+		return syncCtx.handleOrphan(logger, destination, destRepo, result)
+	} else if err != nil {
 		return fmt.Errorf("failed getting repository from source host: %w", err)
 	}
 
-	// Get the refs for the source repository
-	sourceRefs, err := (*sourceRepo).ListRefs(syncCtx.ctx)
+	err = syncCtx.clearOrphan(logger, destination, destRepo)
+	if err != nil {
+		return fmt.Errorf("failed clearing orphaned mark: %w", err)
+	}
+
+	syncCtx.indexBackup(destination, source.source, destRepo)
+
+	err = syncCtx.updateRepo(logger, source.host, destination, sourceRepo, destRepo, result)
+	if err != nil {
+		return err
+	}
+
+	syncCtx.mirrorWiki(logger, source.host, destination, sourceRepo, destRepo, result)
+	if result.Action == ActionUnchanged && result.WikiRefs > 0 {
+		result.Action = ActionUpdated
+	}
+
+	return nil
+}
+
+// Push the changes of the source repository to its backup
+func (syncCtx *syncContext) updateRepo(logger zerolog.Logger, source, destination vcs.Vcs, sourceRepo, destRepo repository.Repository, result *RepositoryResult) error {
+	// Get the refs for the source repository. Both sides are listed with the
+	// patterns of the source, so the other refs of the destination are left
+	// alone.
+	patterns := source.GetConfig().Refs
+	sourceRefs, err := vcs.ListMatchingRefs(syncCtx.ctx, source, sourceRepo, patterns)
 	if err != nil {
 		return fmt.Errorf("failed getting source repository refs: %w", err)
 	}
 
 	// Get the refs for the destination repository
-	destRefs, err := destRepo.ListRefs(syncCtx.ctx)
+	destRefs, err := vcs.ListMatchingRefs(syncCtx.ctx, destination, destRepo, patterns)
 	if err != nil {
 		return fmt.Errorf("failed getting destination repository refs: %w", err)
 	}
 
 	changelog := Refdiff(sourceRefs, destRefs)
+	result.ChangedRefs = len(changelog.ChangedRefs)
+	result.DeletedRefs = len(changelog.DeletedRefs)
+
+	err = syncCtx.checkDeletedRefs(logger, changelog, len(destRefs))
+	if err != nil {
+		return err
+	}
+
 	if changelog.Len() > 0 {
 		logger.Info().
 			Any("changelog", changelog).
 			Msg("Differences found")
 	} else {
 		logger.Debug().Msg("No changes found in refs")
+		result.Action = ActionUnchanged
 		return nil
 	}
 
+	result.Action = ActionUpdated
+
 	// Check the dry-run flag
 	dryRun := syncCtx.ctx.Value(constants.DRY_RUN).(bool)
 	if dryRun {
@@ -313,5 +605,36 @@ func (syncCtx *syncContext) processRepo(logger zerolog.Logger, destRepo reposito
 		return nil
 	}
 
-	return mirrorRefs(syncCtx.ctx, logger, *sourceRepo, destRepo, changelog)
+	release, err := syncCtx.transfers.acquire(syncCtx.ctx, source, destination)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	affected := false
+	stats, err := mirrorRefs(syncCtx.ctx, logger, sourceRepo, destRepo, changelog, mirrorOptions{
+		protection: destination.GetConfig().Protection,
+		checkRewrites: func(rewritten []repository.Ref) error {
+			var err error
+			affected, err = syncCtx.checkUpdate(logger, changelog, rewritten)
+			return err
+		},
+		lfs:      destination.GetConfig().Lfs,
+		destRefs: destRefs,
+	})
+	result.BytesTransferred += stats.bytes
+	result.LfsObjects = stats.lfsObjects
+	result.PreservedRefs += stats.preservedRefs
+	if err != nil {
+		if affected {
+			syncCtx.releaseAffected()
+		}
+
+		return err
+	}
+
+	metrics.RefsChanged.WithLabelValues(destination.GetConfig().Name, destRepo.GetName(), "updated").Add(float64(result.ChangedRefs))
+	metrics.RefsChanged.WithLabelValues(destination.GetConfig().Name, destRepo.GetName(), "deleted").Add(float64(result.DeletedRefs))
+	metrics.RefsChanged.WithLabelValues(destination.GetConfig().Name, destRepo.GetName(), "preserved").Add(float64(stats.preservedRefs))
+	return nil
 }
@@ -0,0 +1,103 @@
+package sync
+
+import (
+	"context"
+	"gitr-backup/vcs/repository"
+	"testing"
+)
+
+// Repository with only a url and a description
+type describedRepository struct {
+	url         string
+	description string
+}
+
+func (repo *describedRepository) GetName() string        { return "repo" }
+func (repo *describedRepository) GetDescription() string { return repo.description }
+func (repo *describedRepository) AddLabel(ctx context.Context, label string) error {
+	return nil
+}
+func (repo *describedRepository) RemoveLabel(ctx context.Context, label string) error {
+	return nil
+}
+func (repo *describedRepository) ListRefs(ctx context.Context) ([]repository.Ref, error) {
+	return nil, nil
+}
+func (repo *describedRepository) GetHttpsCloneUrl() (string, error) { return repo.url, nil }
+func (repo *describedRepository) GetUrl() string                    { return repo.url }
+func (repo *describedRepository) GetDefaultBranch() string          { return "main" }
+func (repo *describedRepository) SetDefaultBranch(ctx context.Context, branch string) error {
+	return nil
+}
+func (repo *describedRepository) SetDescription(ctx context.Context, description string) error {
+	repo.description = description
+	return nil
+}
+
+func TestParseRepositoryState(t *testing.T) {
+	tests := []struct {
+		desc     string
+		expected repositoryState
+	}{
+		{"[backup] https://git.example.com/owner/repo", repositoryState{isBackup: true}},
+		{"[backup] [ignore] https://git.example.com/owner/repo", repositoryState{isBackup: true, ignore: true}},
+		{"[backup] [wiki] https://git.example.com/owner/repo.wiki", repositoryState{isBackup: true, isWiki: true}},
+		{"[backup] https://git.example.com/owner/repo.wiki", repositoryState{isBackup: true}},
+		{"[backup] https://git.example.com/owner/repo [wiki]", repositoryState{isBackup: true}},
+		{"[backup] [orphaned 2024-01-01T00:00:00Z] [ignore] https://git.example.com/owner/repo", repositoryState{isBackup: true, ignore: true}},
+		{"[backup] https://git.example.com/owner/repo Use [ignore] to skip", repositoryState{isBackup: true}},
+		{"[ignore] [backup] https://git.example.com/owner/repo", repositoryState{ignore: true}},
+		{"A [backup] of something", repositoryState{}},
+		{"", repositoryState{}},
+	}
+
+	for _, test := range tests {
+		if state := parseRepositoryState(test.desc); state != test.expected {
+			t.Errorf("%q: expected %+v, got %+v", test.desc, test.expected, state)
+		}
+	}
+}
+
+func TestParseBackupDescription(t *testing.T) {
+	tests := []struct {
+		desc       string
+		sourceUrl  string
+		sourceDesc string
+	}{
+		{"[backup] https://git.example.com/owner/repo", "https://git.example.com/owner/repo", ""},
+		{"[backup] https://git.example.com/owner/repo My project", "https://git.example.com/owner/repo", "My project"},
+		{"[backup] [ignore] https://git.example.com/owner/repo My project", "https://git.example.com/owner/repo", "My project"},
+		{"[backup] [orphaned 2024-01-01T00:00:00Z] https://git.example.com/owner/repo", "https://git.example.com/owner/repo", ""},
+		{"[backup] https://git.example.com/owner/repo Tag releases with [ignore]", "https://git.example.com/owner/repo", "Tag releases with [ignore]"},
+	}
+
+	for _, test := range tests {
+		sourceUrl, sourceDesc := parseBackupDescription(test.desc)
+		if sourceUrl != test.sourceUrl || sourceDesc != test.sourceDesc {
+			t.Errorf("%q: expected (%q, %q), got (%q, %q)", test.desc, test.sourceUrl, test.sourceDesc, sourceUrl, sourceDesc)
+		}
+	}
+}
+
+func TestBackupDescription(t *testing.T) {
+	tests := []struct {
+		sourceDesc string
+		expected   string
+	}{
+		{"", "[backup] https://git.example.com/owner/repo"},
+		{"My project", "[backup] https://git.example.com/owner/repo My project"},
+		{"[ignore] My project", "[backup] https://git.example.com/owner/repo My project"},
+		{"[backup]", "[backup] https://git.example.com/owner/repo"},
+	}
+
+	for _, test := range tests {
+		desc := backupDescription(&describedRepository{url: "https://git.example.com/owner/repo", description: test.sourceDesc})
+		if desc != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.sourceDesc, test.expected, desc)
+		}
+
+		if state := parseRepositoryState(desc); !state.isBackup || state.ignore {
+			t.Errorf("%q: unexpected state %+v", test.sourceDesc, state)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitr-backup/config"
+	"gitr-backup/constants"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func findClient(clients []vcs.Vcs, name string) (vcs.Vcs, error) {
+	for _, client := range clients {
+		if client.GetConfig().Name == name {
+			return client, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown host: %s", name)
+}
+
+func restoreRepo(ctx context.Context, logger zerolog.Logger, backup, target vcs.Vcs, targetRepos map[string]repository.Repository, backupRepo repository.Repository) error {
+	_, description := parseBackupDescription(backupRepo.GetDescription())
+
+	backupRefs, err := vcs.ListMatchingRefs(ctx, backup, backupRepo, backup.GetConfig().Refs)
+	if err != nil {
+		return fmt.Errorf("failed getting backup refs: %w", err)
+	}
+
+	targetRepo, exists := targetRepos[backupRepo.GetName()]
+
+	// Check the dry-run flag
+	dryRun := ctx.Value(constants.DRY_RUN).(bool)
+	if dryRun {
+		logger.Info().Int("refs", len(backupRefs)).Bool("exists", exists).Msg("Would restore the repository, but dry-run mode is enabled")
+		return nil
+	}
+
+	if !exists {
+		logger.Info().Msg("Creating repository on target host")
+
+		targetRepo, err = target.CreateRepository(ctx, &vcs.CreateRepositoryOptions{
+			Name:        backupRepo.GetName(),
+			Description: description,
+		})
+		if err != nil {
+			return fmt.Errorf("failed creating repository: %w", err)
+		}
+	} else {
+		logger.Info().Msg("Repository already exists on target host, pushing refs into it")
+	}
+
+	// Refs that only exist on the target are left alone
+	_, err = mirrorRefs(ctx, logger, backupRepo, targetRepo, FullRefdiff(backupRefs), mirrorOptions{lfs: backup.GetConfig().Lfs})
+	return err
+}
+
+// Push the repositories of a backup host back to a (new) source host. Only
+// backup repositories are restored, optionally filtered by name.
+func RestoreHost(ctx context.Context, config *config.Config, from, to string, names []string) error {
+	clients, err := vcs.LoadClients(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	backup, err := findClient(clients, from)
+	if err != nil {
+		return err
+	}
+
+	target, err := findClient(clients, to)
+	if err != nil {
+		return err
+	}
+
+	if backup == target {
+		return errors.New("cannot restore a host onto itself")
+	}
+
+	backupRepos, err := backup.GetRepositories(ctx)
+	if err != nil {
+		return fmt.Errorf("failed listing backup repositories: %w", err)
+	}
+
+	existingRepos, err := target.GetRepositories(ctx)
+	if err != nil {
+		return fmt.Errorf("failed listing target repositories: %w", err)
+	}
+
+	targetRepos := map[string]repository.Repository{}
+	for _, repo := range existingRepos {
+		targetRepos[repo.GetName()] = repo
+	}
+
+	// Build repository filter
+	repositories := map[string]struct{}{}
+	for _, name := range names {
+		repositories[name] = struct{}{}
+	}
+
+	// Running restores are not interrupted, only the following ones
+	done := ctx.Done()
+	ctx = context.WithoutCancel(ctx)
+
+	errCount := 0
+	skipped := []string{}
+	for _, backupRepo := range backupRepos {
+		if len(repositories) > 0 {
+			if _, ok := repositories[backupRepo.GetName()]; !ok {
+				continue
+			}
+
+			delete(repositories, backupRepo.GetName())
+		}
+
+		logger := log.With().
+			Str("host", to).
+			Str("repository", backupRepo.GetName()).
+			Logger()
+
+		if !parseRepositoryState(backupRepo.GetDescription()).isBackup {
+			logger.Debug().Msg("Not a backup repository, skipping")
+			continue
+		}
+
+		select {
+		case <-done:
+			logger.Warn().Msg("Interrupted, skipping repository")
+			skipped = append(skipped, backupRepo.GetName())
+			continue
+		default:
+		}
+
+		err := restoreRepo(ctx, logger, backup, target, targetRepos, backupRepo)
+		if err != nil {
+			logger.Error().Err(err).Msg("Could not restore repository")
+			errCount += 1
+		}
+	}
+
+	for name := range repositories {
+		log.Error().Str("repository", name).Msg("Repository not found on backup host")
+		errCount += 1
+	}
+
+	if len(skipped) > 0 {
+		return fmt.Errorf("interrupted, %d repositories skipped", len(skipped))
+	}
+
+	if errCount > 0 {
+		return errors.New("some repositories failed")
+	}
+
+	return nil
+}
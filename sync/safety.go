@@ -0,0 +1,87 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"gitr-backup/constants"
+	"gitr-backup/vcs/repository"
+
+	"github.com/rs/zerolog"
+)
+
+// Returned, wrapped, for the changes beyond the safety thresholds
+var ErrDestructiveChange = errors.New("destructive change refused")
+
+// Refuse a destructive change, unless destructive changes were forced on the
+// command line
+func (state *syncContext) refuseDestructive(logger zerolog.Logger, reason string) error {
+	if force, _ := state.ctx.Value(constants.FORCE_DESTRUCTIVE).(bool); force {
+		logger.Warn().Str("reason", reason).Msg("Applying destructive change, as forced")
+		return nil
+	}
+
+	return fmt.Errorf("%w: %s, run with --force-destructive to apply it", ErrDestructiveChange, reason)
+}
+
+func (state *syncContext) checkDeletedRefs(logger zerolog.Logger, changelog RefdiffResult, destRefs int) error {
+	maxPercent := state.safety.MaxDeletedRefsPercent
+	deleted := len(changelog.DeletedRefs)
+	if maxPercent == 0 || deleted == 0 || deleted*100 <= maxPercent*destRefs {
+		return nil
+	}
+
+	return state.refuseDestructive(logger, fmt.Sprintf("%d of %d refs deleted", deleted, destRefs))
+}
+
+func (state *syncContext) checkForceUpdates(logger zerolog.Logger, rewritten int) error {
+	maxForceUpdates := state.safety.MaxForceUpdates
+	if maxForceUpdates == 0 || rewritten <= maxForceUpdates {
+		return nil
+	}
+
+	return state.refuseDestructive(logger, fmt.Sprintf("%d refs force-updated", rewritten))
+}
+
+// Count a repository losing refs, or being deleted, against the number of
+// repositories affected per run
+func (state *syncContext) claimAffected(logger zerolog.Logger) error {
+	maxAffected := int32(state.safety.MaxAffectedRepositories)
+	if maxAffected == 0 {
+		return nil
+	}
+
+	if state.affected.Add(1) <= maxAffected {
+		return nil
+	}
+
+	err := state.refuseDestructive(logger, fmt.Sprintf("more than %d repositories affected in this run", maxAffected))
+	if err != nil {
+		// Refused changes don't count
+		state.affected.Add(-1)
+	}
+
+	return err
+}
+
+// Give back the slot of a repository whose destructive change failed
+func (state *syncContext) releaseAffected() {
+	if state.safety.MaxAffectedRepositories != 0 {
+		state.affected.Add(-1)
+	}
+}
+
+// Check the refs lost by an update before it is pushed, returning whether the
+// repository was counted as affected
+func (state *syncContext) checkUpdate(logger zerolog.Logger, changelog RefdiffResult, rewritten []repository.Ref) (bool, error) {
+	err := state.checkForceUpdates(logger, len(rewritten))
+	if err != nil {
+		return false, err
+	}
+
+	if len(changelog.DeletedRefs) == 0 && len(rewritten) == 0 {
+		return false, nil
+	}
+
+	err = state.claimAffected(logger)
+	return err == nil, err
+}
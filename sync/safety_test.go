@@ -0,0 +1,128 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"gitr-backup/config"
+	"gitr-backup/constants"
+	"gitr-backup/vcs/repository"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func newSafetyContext(safety config.Safety, force bool) *syncContext {
+	return &syncContext{
+		ctx:    context.WithValue(context.Background(), constants.FORCE_DESTRUCTIVE, force),
+		safety: safety,
+	}
+}
+
+func TestCheckDeletedRefs(t *testing.T) {
+	tests := []struct {
+		maxPercent int
+		deleted    int
+		destRefs   int
+		refused    bool
+	}{
+		{0, 10, 10, false},
+		{50, 0, 0, false},
+		{50, 5, 10, false},
+		{50, 6, 10, true},
+		{10, 1, 10, false},
+		{10, 1, 9, true},
+		{100, 10, 10, false},
+	}
+
+	for _, test := range tests {
+		state := newSafetyContext(config.Safety{MaxDeletedRefsPercent: test.maxPercent}, false)
+		err := state.checkDeletedRefs(zerolog.Nop(), RefdiffResult{DeletedRefs: make([]repository.Ref, test.deleted)}, test.destRefs)
+		if refused := errors.Is(err, ErrDestructiveChange); refused != test.refused {
+			t.Errorf("%d%% max, %d of %d deleted: expected refused %v, got %v", test.maxPercent, test.deleted, test.destRefs, test.refused, err)
+		}
+
+		// Forcing always applies the change
+		state = newSafetyContext(config.Safety{MaxDeletedRefsPercent: test.maxPercent}, true)
+		err = state.checkDeletedRefs(zerolog.Nop(), RefdiffResult{DeletedRefs: make([]repository.Ref, test.deleted)}, test.destRefs)
+		if err != nil {
+			t.Errorf("%d%% max, %d of %d deleted, forced: %v", test.maxPercent, test.deleted, test.destRefs, err)
+		}
+	}
+}
+
+func TestCheckForceUpdates(t *testing.T) {
+	tests := []struct {
+		maxForceUpdates int
+		rewritten       int
+		refused         bool
+	}{
+		{0, 100, false},
+		{2, 0, false},
+		{2, 2, false},
+		{2, 3, true},
+	}
+
+	for _, test := range tests {
+		state := newSafetyContext(config.Safety{MaxForceUpdates: test.maxForceUpdates}, false)
+		err := state.checkForceUpdates(zerolog.Nop(), test.rewritten)
+		if refused := errors.Is(err, ErrDestructiveChange); refused != test.refused {
+			t.Errorf("%d max, %d rewritten: expected refused %v, got %v", test.maxForceUpdates, test.rewritten, test.refused, err)
+		}
+	}
+}
+
+func TestClaimAffected(t *testing.T) {
+	state := newSafetyContext(config.Safety{MaxAffectedRepositories: 2}, false)
+
+	for i := 0; i < 2; i++ {
+		if err := state.claimAffected(zerolog.Nop()); err != nil {
+			t.Fatalf("claim %d: %v", i, err)
+		}
+	}
+
+	if err := state.claimAffected(zerolog.Nop()); !errors.Is(err, ErrDestructiveChange) {
+		t.Fatalf("expected the third claim to be refused, got %v", err)
+	}
+
+	// Refused claims don't count, released ones free their slot
+	state.releaseAffected()
+	if err := state.claimAffected(zerolog.Nop()); err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+
+	// Without a limit, nothing is counted
+	state = newSafetyContext(config.Safety{}, false)
+	for i := 0; i < 10; i++ {
+		if err := state.claimAffected(zerolog.Nop()); err != nil {
+			t.Fatalf("unlimited claim %d: %v", i, err)
+		}
+	}
+}
+
+func TestCheckUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		deleted   int
+		rewritten int
+		affected  bool
+		refused   bool
+	}{
+		{"fast-forward", 0, 0, false, false},
+		{"deletion", 1, 0, true, false},
+		{"force update", 0, 1, true, false},
+		{"too many force updates", 0, 3, false, true},
+	}
+
+	for _, test := range tests {
+		state := newSafetyContext(config.Safety{MaxForceUpdates: 2, MaxAffectedRepositories: 1}, false)
+
+		affected, err := state.checkUpdate(zerolog.Nop(), RefdiffResult{DeletedRefs: make([]repository.Ref, test.deleted)}, make([]repository.Ref, test.rewritten))
+		if refused := errors.Is(err, ErrDestructiveChange); refused != test.refused || affected != test.affected {
+			t.Errorf("%s: expected (affected %v, refused %v), got (%v, %v)", test.name, test.affected, test.refused, affected, err)
+		}
+
+		if count := state.affected.Load(); (count == 1) != test.affected {
+			t.Errorf("%s: expected affected %v, got a count of %d", test.name, test.affected, count)
+		}
+	}
+}
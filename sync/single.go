@@ -0,0 +1,125 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitr-backup/constants"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Synchronize a single source repository to all the destinations, e.g. when
+// notified of a push. The backup repository is created if it doesn't exist.
+func (index *Index) SyncSourceRepository(ctx context.Context, sourceUrl string) (*Report, error) {
+	report := &Report{
+		StartedAt:    time.Now(),
+		DryRun:       ctx.Value(constants.DRY_RUN).(bool),
+		Destinations: []*DestinationResult{},
+	}
+
+	clients, err := index.getClients(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	state, err := newSyncContext(ctx, index.config, clients)
+	if err != nil {
+		return report, err
+	}
+
+	state.index = index
+
+	source, err := state.findSourceHost(sourceUrl)
+	if err != nil {
+		return report, err
+	}
+
+	if source == nil {
+		return report, fmt.Errorf("%s does not belong to any source host", sourceUrl)
+	}
+
+	normalized, err := normalizePrefix(sourceUrl)
+	if err != nil {
+		return report, err
+	}
+
+	// The source repository is only looked up if there is a backup to create,
+	// through the listing so the owners of the source host are honored
+	var sourceRepo repository.Repository
+	findSourceRepo := func() (repository.Repository, error) {
+		if sourceRepo != nil {
+			return sourceRepo, nil
+		}
+
+		sourceRepos, err := source.GetRepositories(state.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch source repositories: %w", err)
+		}
+
+		for _, repo := range sourceRepos {
+			if repoUrl, err := normalizePrefix(repo.GetUrl()); err == nil && repoUrl == normalized {
+				sourceRepo = repo
+				return repo, nil
+			}
+		}
+
+		return nil, fmt.Errorf("%s is not a repository of %s", sourceUrl, source.GetConfig().Name)
+	}
+
+	errCount := 0
+	for _, destination := range clients {
+		if destination.GetConfig().Usage != "backup" {
+			continue
+		}
+
+		logger := vcs.GetLogger(destination)
+
+		destReport := &DestinationResult{Name: destination.GetConfig().Name, Repositories: []*RepositoryResult{}}
+		report.Destinations = append(report.Destinations, destReport)
+
+		backupRepo, err := index.findBackup(state.ctx, destination, normalized)
+		if err != nil {
+			logger.Error().Err(err).Msg("Failed looking for the backup repository")
+			destReport.Error = err.Error()
+			errCount += 1
+			continue
+		}
+
+		if backupRepo != nil {
+			logger := logger.With().Str("repository", backupRepo.GetName()).Logger()
+
+			err = state.recordResult(destReport, backupRepo.GetName(), func(result *RepositoryResult) error {
+				return state.processRepo(logger, destination, backupRepo, result)
+			})
+		} else {
+			var repo repository.Repository
+			repo, err = findSourceRepo()
+			if err == nil {
+				logger := logger.With().Str("source", source.GetConfig().Name).Str("repository", repo.GetName()).Logger()
+
+				logger.Info().Msg("Not found in backup, creating")
+				err = state.recordResult(destReport, repo.GetName(), func(result *RepositoryResult) error {
+					return state.backupNewRepo(logger, source, destination, repo, result)
+				})
+			}
+		}
+
+		if err != nil {
+			logger.Error().Err(err).Str("source", sourceUrl).Msg("Could not backup repository")
+			errCount += 1
+		}
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+	log.Info().Str("source", sourceUrl).Dur("duration", report.Duration).Msg("Repository synchronized")
+
+	if errCount > 0 {
+		return report, errors.New("some destinations have failed")
+	}
+
+	return report, nil
+}
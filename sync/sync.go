@@ -3,26 +3,39 @@ package sync
 import (
 	"context"
 	"errors"
+	"fmt"
 	"gitr-backup/config"
+	"gitr-backup/constants"
+	"gitr-backup/metrics"
 	"gitr-backup/vcs"
 	"gitr-backup/vcs/repository"
+	"math/rand/v2"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/rs/zerolog/log"
-	"golang.org/x/sync/semaphore"
 )
 
 type syncContext struct {
 	ctx             context.Context
+	done            <-chan struct{}
 	clients         []vcs.Vcs
 	sourcesByPrefix map[string]vcs.Vcs
 	sourceMapping   map[string]repository.Repository
 	mtx             sync.Mutex
+	workers         int
+	transfers       *transferLimiter
+	safety          config.Safety
+	// Repositories losing refs in this run
+	affected atomic.Int32
+	// Backups found in this run are recorded there, if set
+	index *Index
 }
 
-func newSyncContext(ctx context.Context, clients []vcs.Vcs) (*syncContext, error) {
+func newSyncContext(ctx context.Context, config *config.Config, clients []vcs.Vcs) (*syncContext, error) {
 	// Build the prefix lookup map
 	prefixClients := make(map[string]vcs.Vcs)
 	for _, source := range clients {
@@ -31,37 +44,113 @@ func newSyncContext(ctx context.Context, clients []vcs.Vcs) (*syncContext, error
 			continue
 		}
 
-		// Extract the hostname part of the url
-		parsed, err := url.Parse(cnf.BaseUrl)
-		if err != nil {
-			return nil, err
-		}
-
-		// Clear the path
-		parsed.Path = ""
+		// Normalize the base url, keeping the path for hosts installed
+		// under a prefix
+		for _, prefix := range vcs.GetUrlPrefixes(source) {
+			prefixStr, err := normalizePrefix(prefix)
+			if err != nil {
+				return nil, err
+			}
 
-		// Convert back to string
-		prefixStr := parsed.String()
-		prefixClients[prefixStr] = source
+			prefixClients[prefixStr] = source
+		}
 	}
 
 	return &syncContext{
-		ctx:             ctx,
+		// Running operations are not interrupted, only the scheduling of new
+		// ones is
+		ctx:             context.WithoutCancel(ctx),
+		done:            ctx.Done(),
 		clients:         clients,
 		sourcesByPrefix: prefixClients,
 		sourceMapping:   map[string]repository.Repository{},
 		mtx:             sync.Mutex{},
+		workers:         config.Concurrency.Repositories,
+		transfers:       newTransferLimiter(config),
+		safety:          config.Safety,
 	}, nil
 }
 
-func (state *syncContext) processDestination(destination vcs.Vcs, names []string) error {
+func normalizePrefix(rawUrl string) (string, error) {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	parsed.Host = strings.ToLower(parsed.Host)
+	parsed.Path = strings.TrimRight(parsed.Path, "/")
+	parsed.User = nil
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+
+	return parsed.String(), nil
+}
+
+// Find the source host a repository url belongs to. When multiple hosts share
+// the same hostname under different paths, the longest matching prefix wins.
+func (state *syncContext) findSourceHost(sourceUrl string) (vcs.Vcs, error) {
+	normalized, err := normalizePrefix(sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	var result vcs.Vcs
+	matchLength := -1
+	for prefix, host := range state.sourcesByPrefix {
+		if !strings.HasPrefix(normalized+"/", prefix+"/") {
+			continue
+		}
+
+		if len(prefix) > matchLength {
+			result = host
+			matchLength = len(prefix)
+		}
+	}
+
+	return result, nil
+}
+
+// Run a repository job, recording its result in the report of the destination
+func (state *syncContext) recordResult(report *DestinationResult, name string, cb func(result *RepositoryResult) error) error {
+	result := &RepositoryResult{Name: name}
+	start := time.Now()
+
+	err := cb(result)
+
+	result.Duration = time.Since(start)
+	if errors.Is(err, ErrDestructiveChange) {
+		result.Action = ActionBlocked
+		result.Error = err.Error()
+	} else if err != nil {
+		result.Action = ActionFailed
+		result.Error = err.Error()
+	}
+
+	// Repositories which are not backups are not part of the report
+	if result.Action != "" {
+		report.add(result)
+
+		metrics.RepositoryResults.WithLabelValues(report.Name, string(result.Action)).Inc()
+		// Only backups which are known to be up to date count, for staleness
+		// alerts
+		dryRun := state.ctx.Value(constants.DRY_RUN).(bool)
+		upToDate := result.Action == ActionCreated || result.Action == ActionUpdated || result.Action == ActionUnchanged
+		if upToDate && !dryRun {
+			metrics.RepositoryLastSuccess.WithLabelValues(report.Name, name).SetToCurrentTime()
+		}
+	}
+
+	return err
+}
+
+func (state *syncContext) processDestination(destination vcs.Vcs, names []string, report *DestinationResult) ([]string, error) {
 	logger := vcs.GetLogger(destination)
 
 	logger.Info().Msg("Analyzing state of destination")
 
 	repos, err := destination.GetRepositories(state.ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var errCount int32 = 0
@@ -72,41 +161,51 @@ func (state *syncContext) processDestination(destination vcs.Vcs, names []string
 		repositories[name] = struct{}{}
 	}
 
-	// TODO: Make this configurable
-	sem := semaphore.NewWeighted(1)
-	wg := sync.WaitGroup{}
-	wg.Add(len(repos))
+	selected := func(name string) bool {
+		if len(repositories) == 0 {
+			return true
+		}
+
+		_, ok := repositories[name]
+		return ok
+	}
 
 	// For each known destination repository, try to update it from the source
+	jobs := []job{}
 	for _, destRepo := range repos {
-		go func(destRepo repository.Repository) {
-			defer wg.Done()
+		if !selected(destRepo.GetName()) {
+			continue
+		}
 
-			err := sem.Acquire(state.ctx, 1)
-			if err != nil {
-				logger.Fatal().Err(err).Send()
-			}
-			defer sem.Release(1)
+		jobs = append(jobs, job{
+			name: destRepo.GetName(),
+			run: func() {
+				logger := logger.With().Str("repository", destRepo.GetName()).Logger()
 
-			if len(repositories) > 0 {
-				if _, ok := repositories[destRepo.GetName()]; !ok {
-					return
+				err := state.recordResult(report, destRepo.GetName(), func(result *RepositoryResult) error {
+					return state.processRepo(logger, destination, destRepo, result)
+				})
+				if err != nil {
+					logger.Error().Err(err).Send()
+					atomic.AddInt32(&errCount, 1)
 				}
-			}
+			},
+		})
+	}
 
-			logger := logger.With().Str("repository", destRepo.GetName()).Logger()
+	skipped := runPool(state.done, state.workers, jobs)
+	if len(skipped) > 0 {
+		// Without the full mapping, existing backups would be created again
+		logger.Warn().Msg("Interrupted, not looking for new source repositories")
+		if errCount > 0 {
+			return skipped, errors.New("some repositories failed")
+		}
 
-			err = state.processRepo(logger, destRepo)
-			if err != nil {
-				logger.Error().Err(err).Send()
-				atomic.AddInt32(&errCount, 1)
-			}
-		}(destRepo)
+		return skipped, nil
 	}
 
-	wg.Wait()
-
 	// For each source repository, upload it to the destination if there is no matching destination repository
+	jobs = []job{}
 	for _, source := range state.clients {
 		config := source.GetConfig()
 		if config.Usage != "source" {
@@ -123,81 +222,165 @@ func (state *syncContext) processDestination(destination vcs.Vcs, names []string
 			continue
 		}
 
-		wg.Add(len(sourceRepos))
-
 		for _, sourceRepo := range sourceRepos {
-			go func(sourceRepo repository.Repository) {
-				defer wg.Done()
-
-				err := sem.Acquire(state.ctx, 1)
-				if err != nil {
-					logger.Fatal().Err(err).Send()
-				}
-				defer sem.Release(1)
+			// Wikis get a backup of their own on hosts which don't keep them.
+			// Finding whether a wiki has pages takes a request, so this is
+			// opt-in.
+			wikiName := vcs.WikiName(sourceRepo.GetName())
+			_, found := state.sourceMapping[vcs.WikiUrl(sourceRepo.GetUrl())]
+			if config.Wikis && !found && !vcs.HostsWikis(destination) && selected(wikiName) {
+				jobs = append(jobs, job{
+					name: wikiName,
+					run: func() {
+						logger := logger.With().Str("repository", wikiName).Logger()
+
+						err := state.recordResult(report, wikiName, func(result *RepositoryResult) error {
+							return state.backupNewWiki(logger, source, destination, sourceRepo, result)
+						})
+						if err != nil {
+							logger.Error().Err(err).Msg("Could not backup wiki")
+							atomic.AddInt32(&errCount, 1)
+						}
+					},
+				})
+			}
 
-				if len(repositories) > 0 {
-					if _, ok := repositories[sourceRepo.GetName()]; !ok {
-						return
-					}
-				}
+			if !selected(sourceRepo.GetName()) {
+				continue
+			}
 
-				logger := logger.With().Str("repository", sourceRepo.GetName()).Logger()
+			if _, found := state.sourceMapping[sourceRepo.GetUrl()]; found {
+				continue
+			}
 
-				url := sourceRepo.GetUrl()
-				_, found := state.sourceMapping[url]
+			jobs = append(jobs, job{
+				name: sourceRepo.GetName(),
+				run: func() {
+					logger := logger.With().Str("repository", sourceRepo.GetName()).Logger()
 
-				if !found {
 					logger.Info().Msg("Not found in backup, creating")
-					err := state.backupNewRepo(logger, destination, sourceRepo)
+					err := state.recordResult(report, sourceRepo.GetName(), func(result *RepositoryResult) error {
+						return state.backupNewRepo(logger, source, destination, sourceRepo, result)
+					})
 					if err != nil {
 						logger.Error().Err(err).Msg("Could not backup repository")
 						atomic.AddInt32(&errCount, 1)
 					}
-				}
-			}(sourceRepo)
+				},
+			})
 		}
 	}
 
-	wg.Wait()
+	skipped = runPool(state.done, state.workers, jobs)
+
+	metrics.OrphanedRepositories.WithLabelValues(destination.GetConfig().Name).Set(float64(report.count(ActionOrphaned)))
 
 	if errCount > 0 {
-		return errors.New("some repositories failed")
+		return skipped, errors.New("some repositories failed")
 	}
 
-	return nil
+	return skipped, nil
+}
+
+func SyncHosts(ctx context.Context, config *config.Config, names []string) (*Report, error) {
+	return syncHosts(ctx, config, names, nil)
+}
+
+// Synchronize all the hosts with the clients of the index, recording the
+// backups found in it
+func (index *Index) SyncHosts(ctx context.Context, names []string) (*Report, error) {
+	return syncHosts(ctx, index.config, names, index)
 }
 
-func SyncHosts(ctx context.Context, config *config.Config, names []string) error {
+func syncHosts(ctx context.Context, config *config.Config, names []string, index *Index) (*Report, error) {
 	log.Info().Msgf("%d hosts configured", len(config.Hosts))
 
-	clients, err := vcs.LoadClients(ctx, config)
+	report := &Report{
+		StartedAt:    time.Now(),
+		DryRun:       ctx.Value(constants.DRY_RUN).(bool),
+		Destinations: []*DestinationResult{},
+	}
+
+	var clients []vcs.Vcs
+	var err error
+	if index != nil {
+		clients, err = index.getClients(ctx)
+	} else {
+		clients, err = vcs.LoadClients(ctx, config)
+	}
+
 	if err != nil {
-		log.Fatal().Err(err).Send()
+		return report, err
 	}
 
 	// Create the sync context
-	state, err := newSyncContext(ctx, clients)
+	state, err := newSyncContext(ctx, config, clients)
 	if err != nil {
-		return err
+		return report, err
 	}
 
+	state.index = index
+
 	// For each backup destination, check the source repositories
 	errCount := 0
+	skippedCount := 0
 	for _, destination := range clients {
+		name := destination.GetConfig().Name
 		if destination.GetConfig().Usage != "backup" {
 			continue
 		}
 
-		err := state.processDestination(destination, names)
+		destReport := &DestinationResult{Name: name, Repositories: []*RepositoryResult{}}
+		report.Destinations = append(report.Destinations, destReport)
+
+		// Spread the load of scheduled runs
+		if jitter, _ := ctx.Value(constants.HOST_JITTER).(time.Duration); jitter > 0 {
+			delay := rand.N(jitter)
+			log.Info().Str("host", name).Dur("delay", delay).Msg("Waiting before processing destination")
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+		}
+
+		if ctx.Err() != nil {
+			log.Warn().Str("host", name).Msg("Interrupted, skipping destination")
+			destReport.Error = "skipped, the run was interrupted"
+			skippedCount += 1
+			continue
+		}
+
+		skipped, err := state.processDestination(destination, names, destReport)
 		if err != nil {
-			log.Error().Err(err).Str("host", destination.GetConfig().Name).Msg("Failed processing destination")
+			log.Error().Err(err).Str("host", name).Msg("Failed processing destination")
+			destReport.Error = err.Error()
 			errCount += 1
 		}
+
+		for _, repo := range skipped {
+			log.Warn().Str("host", name).Str("repository", repo).Msg("Skipped repository")
+			destReport.add(&RepositoryResult{Name: repo, Action: ActionSkipped})
+		}
+
+		skippedCount += len(skipped)
+	}
+
+	report.Duration = time.Since(report.StartedAt)
+	metrics.LastRunDuration.Set(report.Duration.Seconds())
+	if ctx.Err() == nil && errCount == 0 {
+		metrics.LastRun.WithLabelValues("success").SetToCurrentTime()
+	} else {
+		metrics.LastRun.WithLabelValues("failure").SetToCurrentTime()
+	}
+
+	if ctx.Err() != nil {
+		return report, fmt.Errorf("interrupted, %d repositories or destinations skipped", skippedCount)
 	}
 
 	if errCount > 0 {
-		return errors.New("some destinations have failed")
+		return report, errors.New("some destinations have failed")
 	}
 
-	return nil
+	return report, nil
 }
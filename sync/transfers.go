@@ -0,0 +1,62 @@
+package sync
+
+import (
+	"context"
+	"gitr-backup/config"
+	"gitr-backup/vcs"
+	"sort"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Limits the number of concurrent clones and pushes, globally and per host
+type transferLimiter struct {
+	global *semaphore.Weighted
+	hosts  map[string]*semaphore.Weighted
+}
+
+func newTransferLimiter(config *config.Config) *transferLimiter {
+	hosts := map[string]*semaphore.Weighted{}
+	for _, host := range config.Hosts {
+		hosts[host.Name] = semaphore.NewWeighted(int64(host.Concurrency.Transfers))
+	}
+
+	return &transferLimiter{
+		global: semaphore.NewWeighted(int64(config.Concurrency.Transfers)),
+		hosts:  hosts,
+	}
+}
+
+// Wait for a transfer slot on all the given hosts. Slots are always taken in
+// the same order, so concurrent transfers can't deadlock.
+func (limiter *transferLimiter) acquire(ctx context.Context, hosts ...vcs.Vcs) (func(), error) {
+	names := []string{}
+	for _, host := range hosts {
+		names = append(names, host.GetConfig().Name)
+	}
+
+	sort.Strings(names)
+
+	sems := []*semaphore.Weighted{limiter.global}
+	for i, name := range names {
+		if sem, found := limiter.hosts[name]; found && (i == 0 || names[i-1] != name) {
+			sems = append(sems, sem)
+		}
+	}
+
+	release := func(acquired []*semaphore.Weighted) {
+		for i := len(acquired) - 1; i >= 0; i-- {
+			acquired[i].Release(1)
+		}
+	}
+
+	for i, sem := range sems {
+		err := sem.Acquire(ctx, 1)
+		if err != nil {
+			release(sems[:i])
+			return nil, err
+		}
+	}
+
+	return func() { release(sems) }, nil
+}
@@ -0,0 +1,195 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitr-backup/constants"
+	"gitr-backup/metrics"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+
+	"github.com/rs/zerolog"
+)
+
+// Returned when the repositories of a source host have no wiki
+var errNoWikis = errors.New("repositories of this host have no wiki")
+
+// Get the source repository of a backup. Backups of wikis point to the wiki
+// url of their repository.
+func getSourceRepository(ctx context.Context, host vcs.Vcs, sourceUrl string, isWiki bool) (repository.Repository, error) {
+	if isWiki {
+		parentUrl, _ := vcs.WikiParentUrl(sourceUrl)
+		return getSourceWiki(ctx, host, parentUrl)
+	}
+
+	repo, err := host.GetRepositoryByUrl(ctx, sourceUrl)
+	if err == nil {
+		return *repo, nil
+	}
+
+	// Backups of wikis were not marked at first, so they are only told apart
+	// by their url once no repository is found there
+	parentUrl, legacyWiki := vcs.WikiParentUrl(sourceUrl)
+	if !legacyWiki || !errors.Is(err, vcs.ErrRepositoryNotFound) {
+		return nil, err
+	}
+
+	wiki, wikiErr := getSourceWiki(ctx, host, parentUrl)
+	if errors.Is(wikiErr, vcs.ErrRepositoryNotFound) || errors.Is(wikiErr, errNoWikis) {
+		return nil, err
+	}
+
+	return wiki, wikiErr
+}
+
+// Get the wiki of a source repository, on hosts whose repositories have one
+func getSourceWiki(ctx context.Context, host vcs.Vcs, parentUrl string) (repository.Repository, error) {
+	parent, err := host.GetRepositoryByUrl(ctx, parentUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := (*parent).(repository.WikiHolder); !ok {
+		return nil, errNoWikis
+	}
+
+	wiki, err := vcs.GetWiki(ctx, *parent)
+	if err != nil {
+		return nil, err
+	}
+
+	if wiki == nil {
+		return nil, fmt.Errorf("%w: wiki disabled for %s", vcs.ErrRepositoryNotFound, parentUrl)
+	}
+
+	return wiki, nil
+}
+
+// List the refs of the wiki of a source repository. Forges only create the
+// wiki repository with the first page, so failures are not errors.
+func listSourceWikiRefs(ctx context.Context, logger zerolog.Logger, source vcs.Vcs, wiki repository.Repository) []repository.Ref {
+	refs, err := vcs.ListMatchingRefs(ctx, source, wiki, source.GetConfig().Refs)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Failed listing wiki refs, it may not have been created yet")
+		return nil
+	}
+
+	return refs
+}
+
+// Mirror the wiki of a source repository into the wiki of its backup, once
+// the repository itself is backed up. Failures are reported without failing
+// the backup of the repository.
+func (state *syncContext) mirrorWiki(logger zerolog.Logger, source, destination vcs.Vcs, sourceRepo, destRepo repository.Repository, result *RepositoryResult) {
+	if !source.GetConfig().Wikis || !vcs.HostsWikis(destination) {
+		return
+	}
+
+	err := state.pushWiki(logger, source, destination, sourceRepo, destRepo, result)
+	if err != nil {
+		logger.Error().Err(err).Msg("Failed mirroring wiki")
+		result.WikiError = err.Error()
+	}
+}
+
+// Push the changes of the wiki of a source repository to the wiki of its
+// backup, on hosts which keep wikis
+func (state *syncContext) pushWiki(logger zerolog.Logger, source, destination vcs.Vcs, sourceRepo, destRepo repository.Repository, result *RepositoryResult) error {
+	sourceWiki, err := vcs.GetWiki(state.ctx, sourceRepo)
+	if err != nil || sourceWiki == nil {
+		return err
+	}
+
+	destWiki, err := vcs.GetWiki(state.ctx, destRepo)
+	if err != nil {
+		return err
+	}
+
+	if destWiki == nil {
+		logger.Warn().Msg("Wiki disabled on the backup, not mirroring the source wiki")
+		return nil
+	}
+
+	logger = logger.With().Str("wiki", sourceWiki.GetName()).Logger()
+
+	sourceRefs := listSourceWikiRefs(state.ctx, logger, source, sourceWiki)
+	if len(sourceRefs) == 0 {
+		return nil
+	}
+
+	destRefs, err := vcs.ListMatchingRefs(state.ctx, destination, destWiki, source.GetConfig().Refs)
+	if err != nil {
+		// Nothing gets deleted from an empty wiki, so this is safe
+		logger.Debug().Err(err).Msg("Failed listing backup wiki refs, assuming it is empty")
+		destRefs = nil
+	}
+
+	changelog := Refdiff(sourceRefs, destRefs)
+	result.WikiRefs = changelog.Len()
+	if changelog.Len() == 0 {
+		return nil
+	}
+
+	err = state.checkDeletedRefs(logger, changelog, len(destRefs))
+	if err != nil {
+		return err
+	}
+
+	logger.Info().
+		Any("changelog", changelog).
+		Msg("Differences found in wiki")
+
+	dryRun := state.ctx.Value(constants.DRY_RUN).(bool)
+	if dryRun {
+		logger.Info().Msg("Would synchronize the wikis, but dry-run mode is enabled")
+		return nil
+	}
+
+	release, err := state.transfers.acquire(state.ctx, source, destination)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	affected := false
+	stats, err := mirrorRefs(state.ctx, logger, sourceWiki, destWiki, changelog, mirrorOptions{
+		protection: destination.GetConfig().Protection,
+		checkRewrites: func(rewritten []repository.Ref) error {
+			var err error
+			affected, err = state.checkUpdate(logger, changelog, rewritten)
+			return err
+		},
+	})
+	result.BytesTransferred += stats.bytes
+	result.PreservedRefs += stats.preservedRefs
+	if err != nil {
+		if affected {
+			state.releaseAffected()
+		}
+
+		return err
+	}
+
+	metrics.RefsChanged.WithLabelValues(destination.GetConfig().Name, destRepo.GetName(), "updated").Add(float64(len(changelog.ChangedRefs)))
+	metrics.RefsChanged.WithLabelValues(destination.GetConfig().Name, destRepo.GetName(), "deleted").Add(float64(len(changelog.DeletedRefs)))
+	metrics.RefsChanged.WithLabelValues(destination.GetConfig().Name, destRepo.GetName(), "preserved").Add(float64(stats.preservedRefs))
+	return nil
+}
+
+// Back up the wiki of a source repository into its own repository, on hosts
+// which don't keep wikis. Wikis without pages are skipped until they have
+// some.
+func (state *syncContext) backupNewWiki(logger zerolog.Logger, source, destination vcs.Vcs, sourceRepo repository.Repository, result *RepositoryResult) error {
+	wiki, err := vcs.GetWiki(state.ctx, sourceRepo)
+	if err != nil || wiki == nil {
+		return err
+	}
+
+	if len(listSourceWikiRefs(state.ctx, logger, source, wiki)) == 0 {
+		return nil
+	}
+
+	logger.Info().Msg("Wiki not found in backup, creating")
+	return state.backupNewRepo(logger, source, destination, wiki, result)
+}
@@ -0,0 +1,88 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"gitr-backup/vcs"
+	"gitr-backup/vcs/repository"
+	"testing"
+)
+
+// Repository whose wiki, if any, is another described repository
+type wikiHolderRepository struct {
+	describedRepository
+	wiki *describedRepository
+}
+
+func (repo *wikiHolderRepository) GetWiki(ctx context.Context) (repository.Repository, error) {
+	if repo.wiki == nil {
+		return nil, nil
+	}
+
+	return repo.wiki, nil
+}
+
+// Host serving a fixed set of repositories by url
+type repositoriesHost struct {
+	configuredHost
+	repos map[string]repository.Repository
+}
+
+func (host *repositoriesHost) GetRepositoryByUrl(ctx context.Context, url string) (*repository.Repository, error) {
+	repo, found := host.repos[url]
+	if !found {
+		return nil, vcs.ErrRepositoryNotFound
+	}
+
+	return &repo, nil
+}
+
+func TestGetSourceRepository(t *testing.T) {
+	const base = "https://git.example.com/owner/"
+
+	wiki := &describedRepository{url: base + "forge.wiki"}
+	host := &repositoriesHost{repos: map[string]repository.Repository{
+		base + "forge":      &wikiHolderRepository{describedRepository: describedRepository{url: base + "forge"}, wiki: wiki},
+		base + "nowiki":     &wikiHolderRepository{describedRepository: describedRepository{url: base + "nowiki"}},
+		base + "plain":      &describedRepository{url: base + "plain"},
+		base + "plain.wiki": &describedRepository{url: base + "plain.wiki"},
+		base + "gitonly":    &describedRepository{url: base + "gitonly"},
+	}}
+
+	tests := []struct {
+		name      string
+		sourceUrl string
+		isWiki    bool
+		expected  string
+		notFound  bool
+		fails     bool
+	}{
+		{"repository", base + "forge", false, base + "forge", false, false},
+		{"marked wiki", base + "forge.wiki", true, base + "forge.wiki", false, false},
+		{"unmarked wiki", base + "forge.wiki", false, base + "forge.wiki", false, false},
+		{"repository named like a wiki", base + "plain.wiki", false, base + "plain.wiki", false, false},
+		{"disabled wiki", base + "nowiki.wiki", true, "", true, false},
+		{"unmarked wiki on a host without wikis", base + "gitonly.wiki", false, "", true, false},
+		{"marked wiki on a host without wikis", base + "gitonly.wiki", true, "", false, true},
+		{"missing repository", base + "missing", false, "", true, false},
+	}
+
+	for _, test := range tests {
+		repo, err := getSourceRepository(context.Background(), host, test.sourceUrl, test.isWiki)
+
+		switch {
+		case test.notFound:
+			if !errors.Is(err, vcs.ErrRepositoryNotFound) {
+				t.Errorf("%s: expected not found, got (%v, %v)", test.name, repo, err)
+			}
+		case test.fails:
+			if err == nil || errors.Is(err, vcs.ErrRepositoryNotFound) {
+				t.Errorf("%s: expected an error other than not found, got (%v, %v)", test.name, repo, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case repo.GetUrl() != test.expected:
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, repo.GetUrl())
+		}
+	}
+}
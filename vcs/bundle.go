@@ -0,0 +1,171 @@
+package vcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitr-backup/config"
+	"gitr-backup/vcs/repository"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Bundle is a backup destination storing timestamped git bundles of each
+// repository, for point-in-time restores.
+type Bundle struct {
+	config  *config.Host
+	options *bundleOptions
+}
+
+type bundleOptions struct {
+	Path string `yaml:"path"`
+	// Number of incremental bundles after which a full bundle is written
+	// again, 0 to only write incremental bundles after the first one
+	FullEvery int             `yaml:"full_every"`
+	Retention bundleRetention `yaml:"retention"`
+}
+
+// Number of most recent days, weeks and months to keep a bundle for
+type bundleRetention struct {
+	Daily   int `yaml:"daily"`
+	Weekly  int `yaml:"weekly"`
+	Monthly int `yaml:"monthly"`
+}
+
+func loadBundleOptions(host *config.Host) (*bundleOptions, error) {
+	options := &bundleOptions{}
+	err := host.DecodeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Path == "" {
+		return nil, errors.New("a path is required for a bundle host")
+	}
+
+	if options.FullEvery < 0 || options.Retention.Daily < 0 || options.Retention.Weekly < 0 || options.Retention.Monthly < 0 {
+		return nil, errors.New("bundle options cannot be negative")
+	}
+
+	hasRetention := options.Retention.Daily > 0 || options.Retention.Weekly > 0 || options.Retention.Monthly > 0
+	if hasRetention && options.FullEvery == 0 {
+		// Otherwise every bundle depends on the first one, and nothing can
+		// ever be removed
+		return nil, errors.New("a retention policy requires full_every to be set")
+	}
+
+	options.Path, err = filepath.Abs(options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+func validateBundleConfig(host *config.Host) error {
+	options, err := loadBundleOptions(host)
+	if err != nil {
+		return err
+	}
+
+	if host.Usage != "backup" {
+		return errors.New("a bundle host can only be used as a backup")
+	}
+
+	host.BaseUrl = (&url.URL{Scheme: "file", Path: options.Path}).String()
+
+	return nil
+}
+
+func NewBundleClient(ctx context.Context, config config.Host) (*Bundle, error) {
+	logger := log.With().Str("host", config.Name).Logger()
+
+	logger.Info().Msg("Initializing client")
+
+	options, err := loadBundleOptions(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(options.Path, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().Msgf("Writing bundles to %s", options.Path)
+
+	return &Bundle{config: &config, options: options}, nil
+}
+
+func (bundleClient *Bundle) GetConfig() *config.Host {
+	return bundleClient.config
+}
+
+func (bundleClient *Bundle) GetRepositories(ctx context.Context) ([]repository.Repository, error) {
+	logger := log.With().Str("host", bundleClient.config.Name).Logger()
+
+	entries, err := os.ReadDir(bundleClient.options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	allRepos := []repository.Repository{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		repo := &bundleRepository{
+			host: bundleClient,
+			path: filepath.Join(bundleClient.options.Path, entry.Name()),
+		}
+
+		err := repo.loadManifest()
+		if err != nil {
+			logger.Warn().Err(err).Str("path", entry.Name()).Msg("Skipping invalid bundle directory")
+			continue
+		}
+
+		logger.Debug().Msgf("Found repository: %s (%s)", repo.GetName(), repo.GetDescription())
+		allRepos = append(allRepos, repo)
+	}
+
+	return allRepos, nil
+}
+
+func (bundleClient *Bundle) GetRepositoryByUrl(ctx context.Context, url string) (*repository.Repository, error) {
+	return nil, errors.New("bundle archives cannot be used as a source")
+}
+
+func (bundleClient *Bundle) CreateRepository(ctx context.Context, options *CreateRepositoryOptions) (repository.Repository, error) {
+	path := filepath.Join(bundleClient.options.Path, options.Name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+
+	err := os.MkdirAll(path, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := &bundleRepository{
+		host: bundleClient,
+		path: path,
+		manifest: bundleManifest{
+			Name:        options.Name,
+			Description: options.Description,
+			Labels:      []string{},
+			Bundles:     []bundleEntry{},
+		},
+	}
+
+	err = repo.saveManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
@@ -0,0 +1,475 @@
+package vcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gitr-backup/constants"
+	"gitr-backup/vcs/repository"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	git "github.com/libgit2/git2go/v34"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const bundleManifestName = "manifest.json"
+
+type bundleManifest struct {
+	Name          string        `json:"name"`
+	Description   string        `json:"description"`
+	Labels        []string      `json:"labels"`
+	DefaultBranch string        `json:"default_branch"`
+	Bundles       []bundleEntry `json:"bundles"`
+}
+
+type bundleEntry struct {
+	Id        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Bundle file, empty if nothing had to be bundled (e.g. only deletions)
+	File string `json:"file,omitempty"`
+	Full bool   `json:"full"`
+	// Id of the entry an incremental bundle builds upon
+	Base string `json:"base,omitempty"`
+	// State of all the refs of the repository after this entry
+	Refs []bundleRef `json:"refs"`
+}
+
+type bundleRef struct {
+	RefName string `json:"ref"`
+	Sha     string `json:"sha"`
+	// Missing from the manifests written before annotated tags were told
+	// apart, where the sha is the peeled commit
+	Peeled string `json:"peeled,omitempty"`
+}
+
+func (ref *bundleRef) commit() string {
+	if ref.Peeled != "" {
+		return ref.Peeled
+	}
+
+	return ref.Sha
+}
+
+type bundleRepository struct {
+	host     *Bundle
+	path     string
+	manifest bundleManifest
+}
+
+// Write a v2 git bundle of the given refs from a local repository. Commits
+// reachable from the prerequisites are left out of the bundle.
+func writeBundle(localPath, bundlePath string, refNames []string, prerequisites []string) error {
+	gitRepo, err := git.OpenRepository(localPath)
+	if err != nil {
+		return err
+	}
+	defer gitRepo.Free()
+
+	walk, err := gitRepo.Walk()
+	if err != nil {
+		return err
+	}
+	defer walk.Free()
+
+	pb, err := gitRepo.NewPackbuilder()
+	if err != nil {
+		return err
+	}
+	defer pb.Free()
+
+	var header strings.Builder
+	header.WriteString("# v2 git bundle\n")
+
+	for _, sha := range prerequisites {
+		oid, err := git.NewOid(sha)
+		if err != nil {
+			continue
+		}
+
+		// Commits that are no longer in the repository (e.g. after a force
+		// push) are not ancestors of anything we bundle
+		if walk.Hide(oid) == nil {
+			fmt.Fprintf(&header, "-%s\n", sha)
+		}
+	}
+
+	for _, refName := range refNames {
+		ref, err := gitRepo.References.Lookup(refName)
+		if err != nil {
+			return fmt.Errorf("failed looking up %s: %w", refName, err)
+		}
+
+		target := ref.Target()
+		commit, err := ref.Peel(git.ObjectCommit)
+		if err != nil {
+			ref.Free()
+			return fmt.Errorf("failed peeling %s: %w", refName, err)
+		}
+
+		err = walk.Push(commit.Id())
+		if err == nil && !target.Equal(commit.Id()) {
+			// Annotated tag objects are not part of the commit walk
+			err = pb.Insert(target, refName)
+		}
+
+		commit.Free()
+		ref.Free()
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&header, "%s %s\n", target.String(), refName)
+	}
+
+	header.WriteString("\n")
+
+	err = pb.InsertWalk(walk)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(bundlePath)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(header.String())
+	if err == nil {
+		err = pb.Write(file)
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(bundlePath)
+	}
+
+	return err
+}
+
+func (repo *bundleRepository) getLogger() zerolog.Logger {
+	return log.With().Str("host", repo.host.config.Name).Str("repository", repo.GetName()).Logger()
+}
+
+func (repo *bundleRepository) loadManifest() error {
+	raw, err := os.ReadFile(filepath.Join(repo.path, bundleManifestName))
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, &repo.manifest)
+}
+
+func (repo *bundleRepository) saveManifest() error {
+	raw, err := json.MarshalIndent(&repo.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so an interrupted run doesn't leave a
+	// truncated manifest behind
+	path := filepath.Join(repo.path, bundleManifestName)
+	err = os.WriteFile(path+".tmp", raw, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (repo *bundleRepository) lastEntry() *bundleEntry {
+	if len(repo.manifest.Bundles) == 0 {
+		return nil
+	}
+
+	return &repo.manifest.Bundles[len(repo.manifest.Bundles)-1]
+}
+
+func (repo *bundleRepository) needsFullBundle() bool {
+	if repo.lastEntry() == nil {
+		return true
+	}
+
+	fullEvery := repo.host.options.FullEvery
+	if fullEvery == 0 {
+		return false
+	}
+
+	incremental := 0
+	for i := len(repo.manifest.Bundles) - 1; i >= 0 && !repo.manifest.Bundles[i].Full; i-- {
+		incremental += 1
+	}
+
+	return incremental >= fullEvery
+}
+
+// Split bundle entries, in chronological order, into the ones retained by a
+// retention policy and the expired ones. The last entry is always retained,
+// and retained entries are kept along with the chain of bundles they depend
+// on.
+func retainBundles(entries []bundleEntry, retention bundleRetention) ([]bundleEntry, []bundleEntry) {
+	if len(entries) == 0 || (retention.Daily == 0 && retention.Weekly == 0 && retention.Monthly == 0) {
+		return entries, nil
+	}
+
+	keep := map[string]struct{}{entries[len(entries)-1].Id: {}}
+	keepPeriods := func(count int, period func(t time.Time) string) {
+		seen := map[string]struct{}{}
+		for i := len(entries) - 1; i >= 0 && len(seen) < count; i-- {
+			key := period(entries[i].CreatedAt)
+			if _, found := seen[key]; found {
+				continue
+			}
+
+			seen[key] = struct{}{}
+			keep[entries[i].Id] = struct{}{}
+		}
+	}
+
+	keepPeriods(retention.Daily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepPeriods(retention.Weekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepPeriods(retention.Monthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	// Entries are in chronological order, so walking backwards reaches the
+	// dependents before their bases
+	for i := len(entries) - 1; i >= 0; i-- {
+		if _, found := keep[entries[i].Id]; found && entries[i].Base != "" {
+			keep[entries[i].Base] = struct{}{}
+		}
+	}
+
+	kept := []bundleEntry{}
+	expired := []bundleEntry{}
+	for _, entry := range entries {
+		if _, found := keep[entry.Id]; found {
+			kept = append(kept, entry)
+		} else {
+			expired = append(expired, entry)
+		}
+	}
+
+	return kept, expired
+}
+
+// Drop the bundles which are not retained by the retention policy
+func (repo *bundleRepository) applyRetention(logger zerolog.Logger) {
+	kept, expired := retainBundles(repo.manifest.Bundles, repo.host.options.Retention)
+
+	for _, entry := range expired {
+		if entry.File != "" {
+			logger.Info().Str("bundle", entry.File).Msg("Removing expired bundle")
+			err := os.Remove(filepath.Join(repo.path, entry.File))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				logger.Warn().Err(err).Str("bundle", entry.File).Msg("Failed removing expired bundle")
+			}
+		}
+	}
+
+	repo.manifest.Bundles = kept
+}
+
+// Archive the refs of a local mirror of the source repository as a new
+// bundle.
+func (repo *bundleRepository) Archive(ctx context.Context, localPath string, changedRefs, deletedRefs []repository.Ref) error {
+	logger := repo.getLogger()
+
+	now := time.Now().UTC()
+	entry := bundleEntry{
+		Id:        now.Format("20060102T150405Z"),
+		CreatedAt: now,
+		Full:      repo.needsFullBundle(),
+	}
+
+	// Compute the state of the refs after this bundle
+	state := map[string]bundleRef{}
+	previous := repo.lastEntry()
+	if previous != nil {
+		for _, ref := range previous.Refs {
+			state[ref.RefName] = ref
+		}
+	}
+
+	for _, ref := range deletedRefs {
+		delete(state, ref.RefName)
+	}
+
+	for _, ref := range changedRefs {
+		state[ref.RefName] = bundleRef{RefName: ref.RefName, Sha: ref.Sha, Peeled: ref.Peeled}
+	}
+
+	for _, ref := range state {
+		entry.Refs = append(entry.Refs, ref)
+	}
+
+	sort.Slice(entry.Refs, func(i, j int) bool {
+		return entry.Refs[i].RefName < entry.Refs[j].RefName
+	})
+
+	refNames := []string{}
+	prerequisites := []string{}
+
+	if entry.Full {
+		for _, ref := range entry.Refs {
+			refNames = append(refNames, ref.RefName)
+		}
+	} else {
+		entry.Base = previous.Id
+
+		for _, ref := range changedRefs {
+			refNames = append(refNames, ref.RefName)
+		}
+
+		for _, ref := range previous.Refs {
+			prerequisites = append(prerequisites, ref.commit())
+		}
+	}
+
+	if len(refNames) > 0 {
+		entry.File = entry.Id + ".bundle"
+
+		logger.Info().
+			Str("bundle", entry.File).
+			Bool("full", entry.Full).
+			Int("refs", len(refNames)).
+			Msg("Writing bundle")
+
+		err := writeBundle(localPath, filepath.Join(repo.path, entry.File), refNames, prerequisites)
+		if err != nil {
+			return fmt.Errorf("failed writing bundle: %w", err)
+		}
+	}
+
+	repo.manifest.Bundles = append(repo.manifest.Bundles, entry)
+	repo.applyRetention(logger)
+
+	return repo.saveManifest()
+}
+
+func (repo *bundleRepository) setLabels(ctx context.Context, labels []string) error {
+	if ctx.Value(constants.DRY_RUN).(bool) {
+		return nil
+	}
+
+	repo.manifest.Labels = labels
+	return repo.saveManifest()
+}
+
+func (repo *bundleRepository) GetName() string {
+	if repo.manifest.Name != "" {
+		return repo.manifest.Name
+	}
+
+	return filepath.Base(repo.path)
+}
+
+func (repo *bundleRepository) GetDescription() string {
+	return repo.manifest.Description
+}
+
+func (repo *bundleRepository) AddLabel(ctx context.Context, label string) error {
+	if slices.Contains(repo.manifest.Labels, label) {
+		return nil
+	}
+
+	return repo.setLabels(ctx, append(slices.Clone(repo.manifest.Labels), label))
+}
+
+func (repo *bundleRepository) RemoveLabel(ctx context.Context, label string) error {
+	if !slices.Contains(repo.manifest.Labels, label) {
+		return nil
+	}
+
+	return repo.setLabels(ctx, slices.DeleteFunc(slices.Clone(repo.manifest.Labels), func(l string) bool {
+		return l == label
+	}))
+}
+
+// The manifest records all the refs archived in the last bundle
+func (repo *bundleRepository) ListAllRefs(ctx context.Context) ([]repository.Ref, error) {
+	allRefs := []repository.Ref{}
+
+	last := repo.lastEntry()
+	if last == nil {
+		return allRefs, nil
+	}
+
+	for _, ref := range last.Refs {
+		allRefs = append(allRefs, repository.Ref{
+			Name:    refShortName(ref.RefName),
+			Sha:     ref.Sha,
+			Peeled:  ref.commit(),
+			RefName: ref.RefName,
+		})
+	}
+
+	return allRefs, nil
+}
+
+func (repo *bundleRepository) ListRefs(ctx context.Context) ([]repository.Ref, error) {
+	allRefs, err := repo.ListAllRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterBranchesAndTags(allRefs), nil
+}
+
+func (repo *bundleRepository) GetHttpsCloneUrl() (string, error) {
+	return "", errors.New("bundle archives cannot be cloned, fetch from the bundle files instead")
+}
+
+func (repo *bundleRepository) GetUrl() string {
+	return (&url.URL{Scheme: "file", Path: repo.path}).String()
+}
+
+func (repo *bundleRepository) GetDefaultBranch() string {
+	return repo.manifest.DefaultBranch
+}
+
+func (repo *bundleRepository) SetDefaultBranch(ctx context.Context, branch string) error {
+	repo.manifest.DefaultBranch = branch
+	return repo.saveManifest()
+}
+
+func (repo *bundleRepository) SetDescription(ctx context.Context, description string) error {
+	repo.manifest.Description = description
+	return repo.saveManifest()
+}
+
+func (repo *bundleRepository) Rename(ctx context.Context, name string) error {
+	path := filepath.Join(repo.host.options.Path, name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	err := os.Rename(repo.path, path)
+	if err != nil {
+		return err
+	}
+
+	repo.path = path
+	repo.manifest.Name = name
+	return repo.saveManifest()
+}
+
+func (repo *bundleRepository) Delete(ctx context.Context) error {
+	return os.RemoveAll(repo.path)
+}
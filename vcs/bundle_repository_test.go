@@ -0,0 +1,122 @@
+package vcs
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+// Build one bundle entry per date, with a full bundle every fullEvery entries
+// and incremental ones building upon the previous entry
+func bundleEntries(fullEvery int, dates ...string) []bundleEntry {
+	entries := []bundleEntry{}
+	for i, date := range dates {
+		createdAt, err := time.Parse("2006-01-02T15:04", date)
+		if err != nil {
+			panic(err)
+		}
+
+		entry := bundleEntry{Id: date, CreatedAt: createdAt, Full: i%fullEvery == 0}
+		if !entry.Full {
+			entry.Base = entries[i-1].Id
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func bundleIds(entries []bundleEntry) []string {
+	ids := []string{}
+	for _, entry := range entries {
+		ids = append(ids, entry.Id)
+	}
+
+	return ids
+}
+
+func TestRetainBundles(t *testing.T) {
+	tests := []struct {
+		name      string
+		entries   []bundleEntry
+		retention bundleRetention
+		kept      []string
+	}{
+		{
+			"no policy",
+			bundleEntries(1, "2024-01-01T10:00", "2024-01-02T10:00"),
+			bundleRetention{},
+			[]string{"2024-01-01T10:00", "2024-01-02T10:00"},
+		},
+		{
+			"last entry of each day",
+			bundleEntries(1, "2024-01-01T10:00", "2024-01-02T10:00", "2024-01-03T10:00", "2024-01-03T18:00"),
+			bundleRetention{Daily: 2},
+			[]string{"2024-01-02T10:00", "2024-01-03T18:00"},
+		},
+		{
+			"last entry of each week",
+			// 2024-01-01 is a Monday
+			bundleEntries(1, "2024-01-01T10:00", "2024-01-05T10:00", "2024-01-08T10:00", "2024-01-14T10:00", "2024-01-15T10:00"),
+			bundleRetention{Weekly: 2},
+			[]string{"2024-01-14T10:00", "2024-01-15T10:00"},
+		},
+		{
+			"last entry of each month",
+			bundleEntries(1, "2024-01-10T10:00", "2024-01-31T10:00", "2024-02-15T10:00", "2024-03-01T10:00"),
+			bundleRetention{Monthly: 2},
+			[]string{"2024-02-15T10:00", "2024-03-01T10:00"},
+		},
+		{
+			"combined windows",
+			bundleEntries(1, "2023-12-20T10:00", "2024-01-10T10:00", "2024-01-29T10:00", "2024-02-01T10:00", "2024-02-02T10:00"),
+			bundleRetention{Daily: 1, Weekly: 2, Monthly: 3},
+			[]string{"2023-12-20T10:00", "2024-01-10T10:00", "2024-01-29T10:00", "2024-02-02T10:00"},
+		},
+		{
+			"last entry is always kept",
+			bundleEntries(1, "2024-01-01T10:00", "2024-01-01T12:00"),
+			bundleRetention{Monthly: 1},
+			[]string{"2024-01-01T12:00"},
+		},
+		{
+			"base chain of the last entry",
+			bundleEntries(3, "2024-01-01T10:00", "2024-01-02T10:00", "2024-01-03T10:00", "2024-01-04T10:00", "2024-01-05T10:00"),
+			bundleRetention{Daily: 1},
+			[]string{"2024-01-04T10:00", "2024-01-05T10:00"},
+		},
+		{
+			"base chain of an older entry",
+			bundleEntries(3, "2024-01-01T10:00", "2024-01-02T10:00", "2024-01-03T10:00", "2024-02-01T10:00", "2024-02-02T10:00"),
+			bundleRetention{Monthly: 2},
+			[]string{"2024-01-01T10:00", "2024-01-02T10:00", "2024-01-03T10:00", "2024-02-01T10:00", "2024-02-02T10:00"},
+		},
+		{
+			"chain stops at full bundles",
+			bundleEntries(2, "2024-01-01T10:00", "2024-01-02T10:00", "2024-01-03T10:00", "2024-01-04T10:00", "2024-01-05T10:00"),
+			bundleRetention{Daily: 2},
+			[]string{"2024-01-03T10:00", "2024-01-04T10:00", "2024-01-05T10:00"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			kept, expired := retainBundles(test.entries, test.retention)
+			if ids := bundleIds(kept); !slices.Equal(ids, test.kept) {
+				t.Errorf("expected %v to be kept, got %v", test.kept, ids)
+			}
+
+			if len(kept)+len(expired) != len(test.entries) {
+				t.Errorf("expected %d entries, got %d kept and %d expired", len(test.entries), len(kept), len(expired))
+			}
+
+			// No retained bundle may depend on an expired one
+			for _, entry := range kept {
+				if entry.Base != "" && !slices.Contains(bundleIds(kept), entry.Base) {
+					t.Errorf("%s depends on expired bundle %s", entry.Id, entry.Base)
+				}
+			}
+		})
+	}
+}
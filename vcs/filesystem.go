@@ -0,0 +1,178 @@
+package vcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitr-backup/config"
+	"gitr-backup/vcs/repository"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	git "github.com/libgit2/git2go/v34"
+	"github.com/rs/zerolog/log"
+)
+
+// Filesystem is a host made of bare repositories in a local directory, e.g.
+// a mounted NAS share.
+type Filesystem struct {
+	config  *config.Host
+	options *filesystemOptions
+}
+
+type filesystemOptions struct {
+	Path string `yaml:"path"`
+}
+
+func loadFilesystemOptions(host *config.Host) (*filesystemOptions, error) {
+	options := &filesystemOptions{}
+	err := host.DecodeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Path == "" {
+		return nil, errors.New("a path is required for a filesystem host")
+	}
+
+	options.Path, err = filepath.Abs(options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+func validateFilesystemConfig(host *config.Host) error {
+	options, err := loadFilesystemOptions(host)
+	if err != nil {
+		return err
+	}
+
+	// Expose the directory as the base url, so backup descriptions pointing
+	// to this host can be matched
+	host.BaseUrl = (&url.URL{Scheme: "file", Path: options.Path}).String()
+
+	return nil
+}
+
+func NewFilesystemClient(ctx context.Context, config config.Host) (*Filesystem, error) {
+	logger := log.With().Str("host", config.Name).Logger()
+
+	logger.Info().Msg("Initializing client")
+
+	options, err := loadFilesystemOptions(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(options.Path, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info().Msgf("Using repositories in %s", options.Path)
+
+	return &Filesystem{config: &config, options: options}, nil
+}
+
+func (fsClient *Filesystem) GetConfig() *config.Host {
+	return fsClient.config
+}
+
+func (fsClient *Filesystem) repositoryPath(name string) string {
+	return filepath.Join(fsClient.options.Path, name+".git")
+}
+
+func (fsClient *Filesystem) openRepository(name string) (*filesystemRepository, error) {
+	repo, err := git.OpenRepository(fsClient.repositoryPath(name))
+	if err != nil {
+		return nil, err
+	}
+	repo.Free()
+
+	return &filesystemRepository{
+		host: fsClient,
+		name: name,
+		path: fsClient.repositoryPath(name),
+	}, nil
+}
+
+func (fsClient *Filesystem) GetRepositories(ctx context.Context) ([]repository.Repository, error) {
+	logger := log.With().Str("host", fsClient.config.Name).Logger()
+
+	entries, err := os.ReadDir(fsClient.options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	allRepos := []repository.Repository{}
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), ".git")
+		if !entry.IsDir() || !found {
+			continue
+		}
+
+		repo, err := fsClient.openRepository(name)
+		if err != nil {
+			logger.Warn().Err(err).Str("path", entry.Name()).Msg("Skipping invalid repository")
+			continue
+		}
+
+		logger.Debug().Msgf("Found repository: %s (%s)", repo.GetName(), repo.GetDescription())
+		allRepos = append(allRepos, repo)
+	}
+
+	return allRepos, nil
+}
+
+func (fsClient *Filesystem) GetRepositoryByUrl(ctx context.Context, url string) (*repository.Repository, error) {
+	path, err := relativeRepositoryPath(fsClient.config.BaseUrl, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" || strings.Contains(path, "/") {
+		return nil, errors.New("invalid repository url for this host")
+	}
+
+	if _, err := os.Stat(fsClient.repositoryPath(path)); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrRepositoryNotFound, url)
+	}
+
+	repo, err := fsClient.openRepository(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fsRepo repository.Repository = repo
+	return &fsRepo, nil
+}
+
+func (fsClient *Filesystem) CreateRepository(ctx context.Context, options *CreateRepositoryOptions) (repository.Repository, error) {
+	path := fsClient.repositoryPath(options.Name)
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	}
+
+	repo, err := git.InitRepository(path, true)
+	if err != nil {
+		return nil, err
+	}
+	repo.Free()
+
+	result := &filesystemRepository{
+		host: fsClient,
+		name: options.Name,
+		path: path,
+	}
+
+	err = result.setDescription(options.Description)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,254 @@
+package vcs
+
+import (
+	"context"
+	"fmt"
+	"gitr-backup/constants"
+	"gitr-backup/vcs/repository"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	git "github.com/libgit2/git2go/v34"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Config key holding the labels of a filesystem repository, space-separated
+const labelsConfigKey = "gitr-backup.labels"
+
+type filesystemRepository struct {
+	host *Filesystem
+	name string
+	path string
+}
+
+// List the refs of a local repository
+func listLocalRefs(repo *git.Repository) ([]repository.Ref, error) {
+	iter, err := repo.NewReferenceIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Free()
+
+	allRefs := []repository.Ref{}
+
+	for {
+		ref, err := iter.Next()
+		if git.IsErrorCode(err, git.ErrorCodeIterOver) {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		refName := ref.Name()
+		if ref.Type() == git.ReferenceSymbolic {
+			ref.Free()
+			continue
+		}
+
+		sha := ref.Target().String()
+		peeled := sha
+		commit, err := ref.Peel(git.ObjectCommit)
+		if err == nil {
+			peeled = commit.Id().String()
+			commit.Free()
+		}
+
+		ref.Free()
+
+		allRefs = append(allRefs, repository.Ref{
+			Name:    refShortName(refName),
+			Sha:     sha,
+			Peeled:  peeled,
+			RefName: refName,
+		})
+	}
+
+	return allRefs, nil
+}
+
+func (repo *filesystemRepository) getLogger() zerolog.Logger {
+	return log.With().Str("host", repo.host.config.Name).Str("repository", repo.name).Logger()
+}
+
+func (repo *filesystemRepository) withRepository(cb func(gitRepo *git.Repository) error) error {
+	gitRepo, err := git.OpenRepository(repo.path)
+	if err != nil {
+		return err
+	}
+	defer gitRepo.Free()
+
+	return cb(gitRepo)
+}
+
+func (repo *filesystemRepository) setDescription(description string) error {
+	return os.WriteFile(filepath.Join(repo.path, "description"), []byte(description+"\n"), 0o644)
+}
+
+func (repo *filesystemRepository) getLabels() ([]string, error) {
+	var labels []string
+	err := repo.withRepository(func(gitRepo *git.Repository) error {
+		cfg, err := gitRepo.Config()
+		if err != nil {
+			return err
+		}
+		defer cfg.Free()
+
+		value, err := cfg.LookupString(labelsConfigKey)
+		if git.IsErrorCode(err, git.ErrorCodeNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		labels = strings.Fields(value)
+		return nil
+	})
+
+	return labels, err
+}
+
+func (repo *filesystemRepository) setLabels(ctx context.Context, labels []string) error {
+	if ctx.Value(constants.DRY_RUN).(bool) {
+		return nil
+	}
+
+	return repo.withRepository(func(gitRepo *git.Repository) error {
+		cfg, err := gitRepo.Config()
+		if err != nil {
+			return err
+		}
+		defer cfg.Free()
+
+		return cfg.SetString(labelsConfigKey, strings.Join(labels, " "))
+	})
+}
+
+func (repo *filesystemRepository) GetName() string {
+	return repo.name
+}
+
+func (repo *filesystemRepository) GetDescription() string {
+	raw, err := os.ReadFile(filepath.Join(repo.path, "description"))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(raw))
+}
+
+func (repo *filesystemRepository) AddLabel(ctx context.Context, label string) error {
+	logger := repo.getLogger()
+
+	labels, err := repo.getLabels()
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(labels, label) {
+		return nil
+	}
+
+	logger.Info().Msgf("Adding label %s to repository", label)
+
+	return repo.setLabels(ctx, append(labels, label))
+}
+
+func (repo *filesystemRepository) RemoveLabel(ctx context.Context, label string) error {
+	logger := repo.getLogger()
+
+	labels, err := repo.getLabels()
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(labels, label) {
+		return nil
+	}
+
+	logger.Info().Msgf("Removing label %s from repository", label)
+
+	return repo.setLabels(ctx, slices.DeleteFunc(labels, func(l string) bool {
+		return l == label
+	}))
+}
+
+func (repo *filesystemRepository) ListAllRefs(ctx context.Context) ([]repository.Ref, error) {
+	var allRefs []repository.Ref
+	err := repo.withRepository(func(gitRepo *git.Repository) error {
+		var err error
+		allRefs, err = listLocalRefs(gitRepo)
+		return err
+	})
+
+	return allRefs, err
+}
+
+func (repo *filesystemRepository) ListRefs(ctx context.Context) ([]repository.Ref, error) {
+	allRefs, err := repo.ListAllRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterBranchesAndTags(allRefs), nil
+}
+
+func (repo *filesystemRepository) GetHttpsCloneUrl() (string, error) {
+	// libgit2 pushes to local repositories through file:// urls
+	return repo.GetUrl(), nil
+}
+
+func (repo *filesystemRepository) GetUrl() string {
+	return (&url.URL{Scheme: "file", Path: repo.path}).String()
+}
+
+func (repo *filesystemRepository) GetDefaultBranch() string {
+	var branch string
+	_ = repo.withRepository(func(gitRepo *git.Repository) error {
+		head, err := gitRepo.References.Lookup("HEAD")
+		if err != nil {
+			return err
+		}
+		defer head.Free()
+
+		branch = strings.TrimPrefix(head.SymbolicTarget(), "refs/heads/")
+		return nil
+	})
+
+	return branch
+}
+
+func (repo *filesystemRepository) SetDefaultBranch(ctx context.Context, branch string) error {
+	return repo.withRepository(func(gitRepo *git.Repository) error {
+		return gitRepo.SetHead("refs/heads/" + branch)
+	})
+}
+
+func (repo *filesystemRepository) SetDescription(ctx context.Context, description string) error {
+	return repo.setDescription(description)
+}
+
+func (repo *filesystemRepository) Rename(ctx context.Context, name string) error {
+	path := repo.host.repositoryPath(name)
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	err := os.Rename(repo.path, path)
+	if err != nil {
+		return err
+	}
+
+	repo.name = name
+	repo.path = path
+	return nil
+}
+
+func (repo *filesystemRepository) Delete(ctx context.Context) error {
+	return os.RemoveAll(repo.path)
+}
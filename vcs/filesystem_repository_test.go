@@ -0,0 +1,77 @@
+package vcs
+
+import (
+	"gitr-backup/vcs/repository"
+	"reflect"
+	"testing"
+	"time"
+
+	git "github.com/libgit2/git2go/v34"
+)
+
+func TestListLocalRefs(t *testing.T) {
+	repo, err := git.InitRepository(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Free()
+
+	builder, err := repo.TreeBuilder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer builder.Free()
+
+	treeId, err := builder.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := repo.LookupTree(treeId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Free()
+
+	signature := &git.Signature{Name: "gitr-backup", Email: "gitr-backup@example.com", When: time.Now()}
+	commitId, err := repo.CreateCommit("refs/heads/main", signature, signature, "Initial commit", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commit, err := repo.LookupCommit(commitId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer commit.Free()
+
+	_, err = repo.Tags.CreateLightweight("lightweight", commit, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tagId, err := repo.Tags.Create("annotated", commit, signature, "Annotated tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs, err := listLocalRefs(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actual := map[string]repository.Ref{}
+	for _, ref := range refs {
+		actual[ref.RefName] = ref
+	}
+
+	expected := map[string]repository.Ref{
+		"refs/heads/main":       {Name: "main", Sha: commitId.String(), Peeled: commitId.String(), RefName: "refs/heads/main"},
+		"refs/tags/lightweight": {Name: "lightweight", Sha: commitId.String(), Peeled: commitId.String(), RefName: "refs/tags/lightweight"},
+		"refs/tags/annotated":   {Name: "annotated", Sha: tagId.String(), Peeled: commitId.String(), RefName: "refs/tags/annotated"},
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
@@ -0,0 +1,222 @@
+package vcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitr-backup/config"
+	"gitr-backup/vcs/repository"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Git is a host made of plain git repositories, listed in the configuration
+// instead of discovered through an API.
+type Git struct {
+	config       *config.Host
+	options      *gitOptions
+	repositories []*gitRepository
+}
+
+type gitOptions struct {
+	// Username used for HTTPS authentication when a token is configured
+	Username     string                 `yaml:"username"`
+	Repositories []gitRepositoryOptions `yaml:"repositories"`
+}
+
+type gitRepositoryOptions struct {
+	Url           string `yaml:"url"`
+	Name          string `yaml:"name"`
+	Description   string `yaml:"description"`
+	DefaultBranch string `yaml:"default_branch"`
+}
+
+// Repositories can be listed either as plain clone urls, or as mappings when
+// more settings are needed.
+func (options *gitRepositoryOptions) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&options.Url)
+	}
+
+	type plain gitRepositoryOptions
+	return value.Decode((*plain)(options))
+}
+
+var scpLikeUrl = regexp.MustCompile(`^(?:([^@/]+)@)?([^:/]+):(.*)$`)
+
+// Convert scp-like ssh urls (git@example.com:user/repo.git) to ssh:// urls so
+// they can be parsed and compared with other urls.
+func normalizeCloneUrl(rawUrl string) (string, error) {
+	if !strings.Contains(rawUrl, "://") {
+		match := scpLikeUrl.FindStringSubmatch(rawUrl)
+		if match == nil {
+			return "", fmt.Errorf("invalid clone url: %s", rawUrl)
+		}
+
+		parsed := &url.URL{
+			Scheme: "ssh",
+			Host:   match[2],
+			Path:   "/" + strings.TrimPrefix(match[3], "/"),
+		}
+
+		if match[1] != "" {
+			parsed.User = url.User(match[1])
+		}
+
+		return parsed.String(), nil
+	}
+
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+
+	if parsed.Host == "" {
+		return "", fmt.Errorf("invalid clone url: %s", rawUrl)
+	}
+
+	return parsed.String(), nil
+}
+
+// Get the url of a repository as written in backup descriptions, without
+// credentials.
+func publicCloneUrl(cloneUrl string) string {
+	parsed, err := url.Parse(cloneUrl)
+	if err != nil {
+		return cloneUrl
+	}
+
+	parsed.User = nil
+	return parsed.String()
+}
+
+func loadGitOptions(host *config.Host) (*gitOptions, error) {
+	options := &gitOptions{}
+	err := host.DecodeOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options.Repositories) == 0 {
+		return nil, errors.New("a git host requires a list of repositories")
+	}
+
+	if options.Username == "" {
+		options.Username = "git"
+	}
+
+	names := map[string]struct{}{}
+	for i := range options.Repositories {
+		repo := &options.Repositories[i]
+
+		repo.Url, err = normalizeCloneUrl(repo.Url)
+		if err != nil {
+			return nil, err
+		}
+
+		if repo.Name == "" {
+			parsed, err := url.Parse(repo.Url)
+			if err != nil {
+				return nil, err
+			}
+
+			repo.Name = strings.TrimSuffix(path.Base(parsed.Path), ".git")
+		}
+
+		if _, found := names[repo.Name]; found {
+			return nil, fmt.Errorf("duplicate repository name %s, set a name explicitly", repo.Name)
+		}
+
+		names[repo.Name] = struct{}{}
+	}
+
+	return options, nil
+}
+
+func validateGitConfig(host *config.Host) error {
+	_, err := loadGitOptions(host)
+	return err
+}
+
+func NewGitClient(ctx context.Context, config config.Host) (*Git, error) {
+	logger := log.With().Str("host", config.Name).Logger()
+
+	logger.Info().Msg("Initializing client")
+
+	options, err := loadGitOptions(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Git{config: &config, options: options}
+	for i := range options.Repositories {
+		client.repositories = append(client.repositories, &gitRepository{
+			host:    client,
+			options: &options.Repositories[i],
+		})
+	}
+
+	logger.Info().Msgf("Configured %d repositories", len(client.repositories))
+
+	return client, nil
+}
+
+func (gitClient *Git) GetConfig() *config.Host {
+	return gitClient.config
+}
+
+// Repositories of a git host are not under a common base url, so each of them
+// is its own prefix.
+func (gitClient *Git) GetUrlPrefixes() []string {
+	prefixes := []string{}
+	for _, repo := range gitClient.repositories {
+		prefixes = append(prefixes, repo.GetUrl())
+	}
+
+	return prefixes
+}
+
+func (gitClient *Git) GetRepositories(ctx context.Context) ([]repository.Repository, error) {
+	allRepos := []repository.Repository{}
+	for _, repo := range gitClient.repositories {
+		allRepos = append(allRepos, repo)
+	}
+
+	return allRepos, nil
+}
+
+func (gitClient *Git) GetRepositoryByUrl(ctx context.Context, url string) (*repository.Repository, error) {
+	normalized, err := normalizeCloneUrl(url)
+	if err != nil {
+		return nil, err
+	}
+
+	normalized = strings.TrimSuffix(publicCloneUrl(normalized), "/")
+
+	for _, repo := range gitClient.repositories {
+		if strings.TrimSuffix(repo.GetUrl(), "/") == normalized {
+			var gitRepo repository.Repository = repo
+			return &gitRepo, nil
+		}
+	}
+
+	// Removed from the configuration
+	return nil, fmt.Errorf("%w: %s", ErrRepositoryNotFound, url)
+}
+
+func (gitClient *Git) CreateRepository(ctx context.Context, options *CreateRepositoryOptions) (repository.Repository, error) {
+	// There is no API to create repositories, so they have to exist on the
+	// remote and be listed in the configuration already
+	for _, repo := range gitClient.repositories {
+		if repo.GetName() == options.Name {
+			return repo, nil
+		}
+	}
+
+	return nil, fmt.Errorf("repository %s must be created manually and listed in the git host configuration", options.Name)
+}
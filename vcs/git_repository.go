@@ -0,0 +1,184 @@
+package vcs
+
+import (
+	"context"
+	"errors"
+	"gitr-backup/vcs/repository"
+	"net/url"
+	"os"
+
+	git "github.com/libgit2/git2go/v34"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type gitRepository struct {
+	host    *Git
+	options *gitRepositoryOptions
+}
+
+// Credentials callback for libgit2 operations. HTTPS credentials are embedded
+// in clone urls, so this only handles SSH authentication through the agent.
+func CredentialsCallback(url string, usernameFromUrl string, allowedTypes git.CredentialType) (*git.Credential, error) {
+	if allowedTypes&git.CredentialTypeSSHKey != 0 {
+		if usernameFromUrl == "" {
+			usernameFromUrl = "git"
+		}
+
+		return git.NewCredentialSSHKeyFromAgent(usernameFromUrl)
+	}
+
+	return nil, errors.New("no credentials available for " + url)
+}
+
+// List the refs of a remote repository, like git ls-remote. libgit2 calls
+// can't be interrupted, so the listing is abandoned when the context is done,
+// and finishes in the background.
+func lsRemote(ctx context.Context, cloneUrl string) ([]git.RemoteHead, error) {
+	type result struct {
+		heads []git.RemoteHead
+		err   error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		heads, err := connectAndList(cloneUrl)
+		done <- result{heads, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-done:
+		return result.heads, result.err
+	}
+}
+
+func connectAndList(cloneUrl string) ([]git.RemoteHead, error) {
+	// libgit2 needs a repository to create a remote, even an anonymous one
+	dir, err := os.MkdirTemp("", "gitr-backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	repo, err := git.InitRepository(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.Free()
+
+	remote, err := repo.Remotes.CreateAnonymous(cloneUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Free()
+
+	err = remote.ConnectFetch(&git.RemoteCallbacks{
+		CredentialsCallback: CredentialsCallback,
+	}, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Disconnect()
+
+	return remote.Ls()
+}
+
+func (repo *gitRepository) getLogger() zerolog.Logger {
+	return log.With().Str("host", repo.host.config.Name).Str("repository", repo.GetName()).Logger()
+}
+
+func (repo *gitRepository) GetName() string {
+	return repo.options.Name
+}
+
+func (repo *gitRepository) GetDescription() string {
+	return repo.options.Description
+}
+
+func (repo *gitRepository) AddLabel(ctx context.Context, label string) error {
+	// Plain git repositories have no labels
+	return nil
+}
+
+func (repo *gitRepository) RemoveLabel(ctx context.Context, label string) error {
+	return nil
+}
+
+func (repo *gitRepository) ListAllRefs(ctx context.Context) ([]repository.Ref, error) {
+	cloneUrl, err := repo.GetHttpsCloneUrl()
+	if err != nil {
+		return nil, err
+	}
+
+	allRefs, _, err := lsRemoteRefs(ctx, cloneUrl)
+	return allRefs, err
+}
+
+func (repo *gitRepository) ListRefs(ctx context.Context) ([]repository.Ref, error) {
+	allRefs, err := repo.ListAllRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterBranchesAndTags(allRefs), nil
+}
+
+func (repo *gitRepository) GetHttpsCloneUrl() (string, error) {
+	parsed, err := url.Parse(repo.options.Url)
+	if err != nil {
+		return "", err
+	}
+
+	if parsed.Scheme == "https" && repo.host.config.Token != "" {
+		parsed.User = url.UserPassword(repo.host.options.Username, repo.host.config.Token)
+	}
+
+	return parsed.String(), nil
+}
+
+func (repo *gitRepository) GetUrl() string {
+	return publicCloneUrl(repo.options.Url)
+}
+
+// Get the default branch set in the configuration, if any
+func (repo *gitRepository) GetDefaultBranch() string {
+	return repo.options.DefaultBranch
+}
+
+func (repo *gitRepository) ResolveDefaultBranch(ctx context.Context) (string, error) {
+	if repo.options.DefaultBranch != "" {
+		return repo.options.DefaultBranch, nil
+	}
+
+	cloneUrl, err := repo.GetHttpsCloneUrl()
+	if err != nil {
+		return "", err
+	}
+
+	_, headBranch, err := lsRemoteRefs(ctx, cloneUrl)
+	if err != nil {
+		return "", err
+	}
+
+	logger := repo.getLogger()
+	logger.Debug().Str("default_branch", headBranch).Msg("Guessed default branch")
+
+	return headBranch, nil
+}
+
+func (repo *gitRepository) SetDefaultBranch(ctx context.Context, branch string) error {
+	// The git protocol can't update the HEAD of a remote repository
+	logger := repo.getLogger()
+	logger.Warn().Str("branch", branch).Msg("Cannot set the default branch of a plain git repository")
+
+	return nil
+}
+
+func (repo *gitRepository) SetDescription(ctx context.Context, description string) error {
+	logger := repo.getLogger()
+	logger.Warn().Msg("Cannot set the description of a plain git repository")
+
+	return nil
+}
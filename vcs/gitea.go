@@ -3,8 +3,10 @@ package vcs
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"strconv"
-	"sync"
+	"strings"
 
 	"gitr-backup/config"
 	"gitr-backup/vcs/repository"
@@ -14,11 +16,11 @@ import (
 )
 
 type Gitea struct {
-	config         *config.Host
-	client         *gitea.Client
-	mutex          *sync.Mutex
-	username       string
-	initialContext context.Context
+	config     *config.Host
+	client     *gitea.Client
+	httpClient *http.Client
+	version    string
+	username   string
 }
 
 func NewGiteaClient(ctx context.Context, config config.Host) (*Gitea, error) {
@@ -26,49 +28,121 @@ func NewGiteaClient(ctx context.Context, config config.Host) (*Gitea, error) {
 
 	logger.Info().Msg("Initializing client")
 
-	client, err := gitea.NewClient(config.BaseUrl, gitea.SetToken(config.Token), gitea.SetContext(ctx))
+	httpClient := newApiHttpClient(&config)
+	client, err := gitea.NewClient(config.BaseUrl, gitea.SetToken(config.Token), gitea.SetContext(ctx), gitea.SetHTTPClient(httpClient))
+	if err != nil {
+		return nil, err
+	}
+
+	version, _, err := client.ServerVersion()
 	if err != nil {
 		return nil, err
 	}
 
 	user, _, err := client.GetMyUserInfo()
 	if err != nil {
-		log.Fatal().Err(err).Send()
+		return nil, err
 	}
 
 	username := user.UserName
 	logger.Info().Msgf("Logged in as %s", user.FullName)
 
-	return &Gitea{config: &config, client: client, mutex: &sync.Mutex{}, username: username, initialContext: ctx}, nil
+	return &Gitea{config: &config, client: client, httpClient: httpClient, version: version, username: username}, nil
 }
 
-func (giteaClient *Gitea) withContext(ctx context.Context, cb func(client *gitea.Client) error) error {
-	// We need the mutex to protect against setting the default context for the current request
-	giteaClient.mutex.Lock()
+func validateGiteaConfig(host *config.Host) error {
+	if host.BaseUrl == "" {
+		return errors.New("a base url is required for a gitea host")
+	}
 
-	giteaClient.client.SetContext(ctx)
-	err := cb(giteaClient.client)
-	giteaClient.client.SetContext(giteaClient.initialContext)
+	return requireToken(host)
+}
 
-	giteaClient.mutex.Unlock()
+func (giteaClient *Gitea) withContext(ctx context.Context, cb func(client *gitea.Client) error) error {
+	// The context of a client is shared by all its requests, so use a client
+	// per call instead of serializing them. The server version is known
+	// already, so creating one doesn't make any request.
+	client, err := gitea.NewClient(
+		giteaClient.config.BaseUrl,
+		gitea.SetToken(giteaClient.config.Token),
+		gitea.SetContext(ctx),
+		gitea.SetHTTPClient(giteaClient.httpClient),
+		gitea.SetGiteaVersion(giteaClient.version),
+	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return cb(client)
 }
 
 func (giteaClient *Gitea) GetConfig() *config.Host {
 	return giteaClient.config
 }
 
+// Backups keep the wiki enabled, so wikis are pushed to the wiki of the backup
+func (giteaClient *Gitea) HostsWikis() bool {
+	return true
+}
+
 func (giteaClient *Gitea) GetRepositories(ctx context.Context) ([]repository.Repository, error) {
-	logger := log.With().Str("host", giteaClient.config.Name).Logger()
+	allRepos := []repository.Repository{}
+
+	for _, owner := range ownersOrDefault(giteaClient.config, giteaClient.username) {
+		repos, err := giteaClient.getOwnerRepositories(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		allRepos = append(allRepos, repos...)
+	}
+
+	return allRepos, nil
+}
+
+func (giteaClient *Gitea) getOwnerRepositories(ctx context.Context, owner string) ([]repository.Repository, error) {
+	logger := log.With().Str("host", giteaClient.config.Name).Str("owner", owner).Logger()
+
+	var list func(client *gitea.Client, listOptions gitea.ListOptions) ([]*gitea.Repository, *gitea.Response, error)
+
+	// Gitea user and organization names are case-insensitive
+	if strings.EqualFold(owner, giteaClient.username) {
+		// Only the "my repos" endpoint returns private repositories, but it
+		// also returns the repositories of organizations the user belongs to
+		list = func(client *gitea.Client, listOptions gitea.ListOptions) ([]*gitea.Repository, *gitea.Response, error) {
+			return client.ListMyRepos(gitea.ListReposOptions{ListOptions: listOptions})
+		}
+	} else {
+		var isOrg bool
+		err := giteaClient.withContext(ctx, func(client *gitea.Client) error {
+			_, resp, err := client.GetOrg(owner)
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return nil
+			}
+
+			isOrg = err == nil
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if isOrg {
+			list = func(client *gitea.Client, listOptions gitea.ListOptions) ([]*gitea.Repository, *gitea.Response, error) {
+				return client.ListOrgRepos(owner, gitea.ListOrgReposOptions{ListOptions: listOptions})
+			}
+		} else {
+			list = func(client *gitea.Client, listOptions gitea.ListOptions) ([]*gitea.Repository, *gitea.Response, error) {
+				return client.ListUserRepos(owner, gitea.ListReposOptions{ListOptions: listOptions})
+			}
+		}
+	}
 
 	allRepos := []repository.Repository{}
-	ignoredRepoCount := 0
-	options := gitea.ListReposOptions{
-		ListOptions: gitea.ListOptions{
-			Page:     1,
-			PageSize: 50,
-		},
+	seenRepoCount := 0
+	options := gitea.ListOptions{
+		Page:     1,
+		PageSize: 50,
 	}
 
 	for {
@@ -77,16 +151,17 @@ func (giteaClient *Gitea) GetRepositories(ctx context.Context) ([]repository.Rep
 
 		err := giteaClient.withContext(ctx, func(client *gitea.Client) error {
 			var err error
-			repos, resp, err = client.ListMyRepos(options)
+			repos, resp, err = list(client, options)
 			return err
 		})
 		if err != nil {
 			return nil, err
 		}
 
+		seenRepoCount += len(repos)
+
 		for _, repo := range repos {
-			if repo.Owner.UserName != giteaClient.username {
-				ignoredRepoCount += 1
+			if !strings.EqualFold(repo.Owner.UserName, owner) {
 				continue
 			}
 
@@ -102,29 +177,66 @@ func (giteaClient *Gitea) GetRepositories(ctx context.Context) ([]repository.Rep
 			return nil, err
 		}
 
-		if totalCount <= ignoredRepoCount+len(allRepos) {
+		if totalCount <= seenRepoCount || len(repos) == 0 {
 			break
 		}
 
-		options.ListOptions.Page += 1
+		options.Page += 1
 	}
 
 	return allRepos, nil
 }
 
 func (giteaClient *Gitea) GetRepositoryByUrl(ctx context.Context, url string) (*repository.Repository, error) {
-	return nil, errors.New("not implemented")
+	path, err := relativeRepositoryPath(giteaClient.config.BaseUrl, url)
+	if err != nil {
+		return nil, err
+	}
+
+	repositoryParts := strings.Split(path, "/")
+	if len(repositoryParts) != 2 || repositoryParts[0] == "" || repositoryParts[1] == "" {
+		return nil, errors.New("invalid repository url for this host")
+	}
+
+	var repo *gitea.Repository
+	err = giteaClient.withContext(ctx, func(client *gitea.Client) error {
+		var resp *gitea.Response
+		var err error
+		repo, resp, err = client.GetRepo(repositoryParts[0], repositoryParts[1])
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s", ErrRepositoryNotFound, url)
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var giteaRepo repository.Repository = &giteaRepository{
+		host: giteaClient,
+		repo: repo,
+	}
+
+	return &giteaRepo, nil
 }
 
 func (giteaClient *Gitea) CreateRepository(ctx context.Context, options *CreateRepositoryOptions) (repository.Repository, error) {
+	org := backupOwner(giteaClient.config, giteaClient.username)
+	createOptions := gitea.CreateRepoOption{
+		Name:        options.Name,
+		Description: options.Description,
+		Private:     true,
+	}
+
 	var repo *gitea.Repository
 	err := giteaClient.withContext(ctx, func(client *gitea.Client) error {
 		var err error
-		repo, _, err = client.CreateRepo(gitea.CreateRepoOption{
-			Name:        options.Name,
-			Description: options.Description,
-			Private:     true,
-		})
+		if org != "" {
+			repo, _, err = client.CreateOrgRepo(org, createOptions)
+		} else {
+			repo, _, err = client.CreateRepo(createOptions)
+		}
 		return err
 	})
 	if err != nil {
@@ -135,7 +247,7 @@ func (giteaClient *Gitea) CreateRepository(ctx context.Context, options *CreateR
 	// an existing label, it may run arbitrary code if it's updated from a
 	// fork, for example.
 	err = giteaClient.withContext(ctx, func(client *gitea.Client) error {
-		_, _, err := client.EditRepo(repo.Owner.LoginName, repo.Name, gitea.EditRepoOption{
+		_, _, err := client.EditRepo(repo.Owner.UserName, repo.Name, gitea.EditRepoOption{
 			HasActions: gitea.OptionalBool(false),
 		})
 		return err
@@ -28,7 +28,7 @@ func (repo *giteaRepository) getLogger() zerolog.Logger {
 func (repo *giteaRepository) ensureTopics(ctx context.Context) error {
 	logger := repo.getLogger()
 
-	user := repo.host.username
+	user := repo.repo.Owner.UserName
 	name := repo.repo.Name
 
 	if !repo.topicsInitialized {
@@ -160,6 +160,7 @@ func (repo *giteaRepository) ListRefs(ctx context.Context) ([]repository.Ref, er
 			allRefs = append(allRefs, repository.Ref{
 				Name:    ref.Name,
 				Sha:     ref.Commit.ID,
+				Peeled:  ref.Commit.ID,
 				RefName: fmt.Sprintf("refs/heads/%s", ref.Name),
 			})
 		}
@@ -203,7 +204,8 @@ func (repo *giteaRepository) ListRefs(ctx context.Context) ([]repository.Ref, er
 			name := strings.TrimPrefix(ref.Name, "tags/")
 			allRefs = append(allRefs, repository.Ref{
 				Name:    name,
-				Sha:     ref.Commit.SHA,
+				Sha:     ref.ID,
+				Peeled:  ref.Commit.SHA,
 				RefName: fmt.Sprintf("refs/tags/%s", name),
 			})
 		}
@@ -242,11 +244,17 @@ func (repo *giteaRepository) GetDefaultBranch() string {
 	return repo.repo.DefaultBranch
 }
 
-func (repo *giteaRepository) SetDefaultBranch(ctx context.Context, branch string) error {
+func (repo *giteaRepository) GetWiki(ctx context.Context) (repository.Repository, error) {
+	if !repo.repo.HasWiki {
+		return nil, nil
+	}
+
+	return newWikiRepository(repo.host, repo), nil
+}
+
+func (repo *giteaRepository) edit(ctx context.Context, changes gitea.EditRepoOption) error {
 	return repo.host.withContext(ctx, func(client *gitea.Client) error {
-		r, _, err := client.EditRepo(repo.repo.Owner.UserName, repo.repo.Name, gitea.EditRepoOption{
-			DefaultBranch: &branch,
-		})
+		r, _, err := client.EditRepo(repo.repo.Owner.UserName, repo.repo.Name, changes)
 
 		if err != nil {
 			return err
@@ -256,3 +264,30 @@ func (repo *giteaRepository) SetDefaultBranch(ctx context.Context, branch string
 		return nil
 	})
 }
+
+func (repo *giteaRepository) SetDefaultBranch(ctx context.Context, branch string) error {
+	return repo.edit(ctx, gitea.EditRepoOption{DefaultBranch: &branch})
+}
+
+func (repo *giteaRepository) SetDescription(ctx context.Context, description string) error {
+	return repo.edit(ctx, gitea.EditRepoOption{Description: &description})
+}
+
+func (repo *giteaRepository) IsArchived() bool {
+	return repo.repo.Archived
+}
+
+func (repo *giteaRepository) SetArchived(ctx context.Context, archived bool) error {
+	return repo.edit(ctx, gitea.EditRepoOption{Archived: &archived})
+}
+
+func (repo *giteaRepository) Rename(ctx context.Context, name string) error {
+	return repo.edit(ctx, gitea.EditRepoOption{Name: &name})
+}
+
+func (repo *giteaRepository) Delete(ctx context.Context) error {
+	return repo.host.withContext(ctx, func(client *gitea.Client) error {
+		_, err := client.DeleteRepo(repo.repo.Owner.UserName, repo.repo.Name)
+		return err
+	})
+}
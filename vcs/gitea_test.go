@@ -0,0 +1,119 @@
+package vcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+
+	"gitr-backup/config"
+
+	"code.gitea.io/sdk/gitea"
+)
+
+// Serve the repositories of a Gitea instance installed under /gitea
+func newGiteaStub(t *testing.T, repos map[string]any) *Gitea {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, found := repos[r.URL.Path]
+		if r.Method != http.MethodGet || !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		if list, ok := repo.([]*gitea.Repository); ok {
+			w.Header().Set("X-Total-Count", strconv.Itoa(len(list)))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(repo)
+	}))
+	t.Cleanup(server.Close)
+
+	return &Gitea{
+		config:     &config.Host{Name: "gitea", BaseUrl: server.URL + "/gitea", Token: "token"},
+		httpClient: server.Client(),
+		version:    "1.21.0",
+		username:   "backup",
+	}
+}
+
+func TestGiteaGetRepositoryByUrl(t *testing.T) {
+	host := newGiteaStub(t, map[string]any{
+		"/gitea/api/v1/repos/owner/repo": &gitea.Repository{Name: "repo", Owner: &gitea.User{UserName: "owner"}},
+	})
+	base := host.config.BaseUrl
+
+	tests := []struct {
+		name     string
+		url      string
+		notFound bool
+		wantErr  bool
+	}{
+		{"html url", base + "/owner/repo", false, false},
+		{"clone url", base + "/owner/repo.git", false, false},
+		{"trailing slash", base + "/owner/repo/", false, false},
+		{"missing repository", base + "/owner/other", true, true},
+		{"missing name", base + "/owner", false, true},
+		{"nested path", base + "/owner/repo/extra", false, true},
+		{"outside path prefix", host.config.BaseUrl + "2/owner/repo", false, true},
+		{"foreign host", "https://gitea.example.com/gitea/owner/repo", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo, err := host.GetRepositoryByUrl(context.Background(), test.url)
+			if errors.Is(err, ErrRepositoryNotFound) != test.notFound {
+				t.Fatalf("unexpected not found error: %v", err)
+			}
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if name := (*repo).GetName(); name != "repo" {
+				t.Errorf("expected repo, got %s", name)
+			}
+		})
+	}
+}
+
+func TestGiteaGetRepositoriesOwnerCase(t *testing.T) {
+	host := newGiteaStub(t, map[string]any{
+		"/gitea/api/v1/user/repos": []*gitea.Repository{
+			{Name: "mine", Owner: &gitea.User{UserName: "backup"}},
+			{Name: "member", Owner: &gitea.User{UserName: "other"}},
+		},
+		"/gitea/api/v1/orgs/MyOrg": &gitea.Organization{UserName: "myorg"},
+		"/gitea/api/v1/orgs/MyOrg/repos": []*gitea.Repository{
+			{Name: "shared", Owner: &gitea.User{UserName: "myorg"}},
+		},
+	})
+	host.config.Owners = []string{"Backup", "MyOrg"}
+
+	repos, err := host.GetRepositories(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, repo := range repos {
+		names = append(names, repo.GetName())
+	}
+
+	expected := []string{"mine", "shared"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
@@ -3,12 +3,16 @@ package vcs
 import (
 	"context"
 	"errors"
+	"fmt"
 	"gitr-backup/config"
 	"gitr-backup/vcs/repository"
+	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/google/go-github/v50/github"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
 )
 
 type GitHub struct {
@@ -22,17 +26,30 @@ func NewGitHubClient(ctx context.Context, config config.Host) (*GitHub, error) {
 
 	logger.Info().Msg("Initializing client")
 
+	httpCtx := context.WithValue(ctx, oauth2.HTTPClient, newApiHttpClient(&config))
+	httpClient := oauth2.NewClient(httpCtx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: config.Token}))
+
 	var client *github.Client
 
-	if config.BaseUrl != "" && !strings.HasPrefix(config.BaseUrl, "https://github.com") {
-		return nil, errors.New("GHES not supported yet")
+	public, err := isGitHubCom(config.BaseUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if !public {
+		// GitHub Enterprise Server: the API and upload endpoints are derived
+		// from the base url, including any path prefix
+		client, err = github.NewEnterpriseClient(config.BaseUrl, config.BaseUrl, httpClient)
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		client = github.NewTokenClient(ctx, config.Token)
+		client = github.NewClient(httpClient)
 	}
 
 	user, _, err := client.Users.Get(ctx, "")
 	if err != nil {
-		log.Fatal().Err(err).Send()
+		return nil, err
 	}
 
 	username := user.GetLogin()
@@ -41,22 +58,89 @@ func NewGitHubClient(ctx context.Context, config config.Host) (*GitHub, error) {
 	return &GitHub{config: &config, client: client, username: username}, nil
 }
 
+// Check whether a base url is the one of github.com, rather than of a GitHub
+// Enterprise Server
+func isGitHubCom(baseUrl string) (bool, error) {
+	if baseUrl == "" {
+		return true, nil
+	}
+
+	parsed, err := url.Parse(baseUrl)
+	if err != nil {
+		return false, err
+	}
+
+	return strings.EqualFold(parsed.Host, "github.com"), nil
+}
+
+func validateGitHubConfig(host *config.Host) error {
+	if host.BaseUrl == "" {
+		host.BaseUrl = "https://github.com"
+	}
+
+	return requireToken(host)
+}
+
 func (githubClient *GitHub) GetConfig() *config.Host {
 	return githubClient.config
 }
 
 func (githubClient *GitHub) GetRepositories(ctx context.Context) ([]repository.Repository, error) {
-	logger := log.With().Str("host", githubClient.config.Name).Logger()
-
 	allRepos := []repository.Repository{}
-	options := &github.RepositoryListOptions{
-		ListOptions: github.ListOptions{
-			PerPage: 50,
-		},
+
+	for _, owner := range ownersOrDefault(githubClient.config, githubClient.username) {
+		repos, err := githubClient.getOwnerRepositories(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		allRepos = append(allRepos, repos...)
 	}
 
+	return allRepos, nil
+}
+
+func (githubClient *GitHub) getOwnerRepositories(ctx context.Context, owner string) ([]repository.Repository, error) {
+	logger := log.With().Str("host", githubClient.config.Name).Str("owner", owner).Logger()
+
+	var list func(page int) ([]*github.Repository, *github.Response, error)
+
+	if owner == githubClient.username {
+		// Listing with an empty user returns the private repositories of the
+		// authenticated user, which is where backups are created
+		list = func(page int) ([]*github.Repository, *github.Response, error) {
+			return githubClient.client.Repositories.List(ctx, "", &github.RepositoryListOptions{
+				Affiliation: "owner",
+				ListOptions: github.ListOptions{PerPage: 50, Page: page},
+			})
+		}
+	} else {
+		user, _, err := githubClient.client.Users.Get(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		if user.GetType() == "Organization" {
+			list = func(page int) ([]*github.Repository, *github.Response, error) {
+				return githubClient.client.Repositories.ListByOrg(ctx, owner, &github.RepositoryListByOrgOptions{
+					Type:        "all",
+					ListOptions: github.ListOptions{PerPage: 50, Page: page},
+				})
+			}
+		} else {
+			list = func(page int) ([]*github.Repository, *github.Response, error) {
+				return githubClient.client.Repositories.List(ctx, owner, &github.RepositoryListOptions{
+					ListOptions: github.ListOptions{PerPage: 50, Page: page},
+				})
+			}
+		}
+	}
+
+	allRepos := []repository.Repository{}
+	page := 0
+
 	for {
-		repos, resp, err := githubClient.client.Repositories.List(ctx, githubClient.username, options)
+		repos, resp, err := list(page)
 		if err != nil {
 			return nil, err
 		}
@@ -73,20 +157,27 @@ func (githubClient *GitHub) GetRepositories(ctx context.Context) ([]repository.R
 			break
 		}
 
-		options.ListOptions.Page = resp.NextPage
+		page = resp.NextPage
 	}
 
 	return allRepos, nil
 }
 
 func (githubClient *GitHub) GetRepositoryByUrl(ctx context.Context, url string) (*repository.Repository, error) {
-	repositoryParts := strings.SplitN(strings.TrimLeft(strings.TrimPrefix(url, githubClient.config.BaseUrl), "/"), "/", 3)
+	path, err := relativeRepositoryPath(githubClient.config.BaseUrl, url)
+	if err != nil {
+		return nil, err
+	}
+
+	repositoryParts := strings.SplitN(path, "/", 3)
 	if len(repositoryParts) != 2 {
 		return nil, errors.New("invalid repository url for this host")
 	}
 
-	repo, _, err := githubClient.client.Repositories.Get(ctx, repositoryParts[0], repositoryParts[1])
-	if err != nil {
+	repo, resp, err := githubClient.client.Repositories.Get(ctx, repositoryParts[0], repositoryParts[1])
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrRepositoryNotFound, url)
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -99,15 +190,40 @@ func (githubClient *GitHub) GetRepositoryByUrl(ctx context.Context, url string)
 }
 
 func (githubClient *GitHub) CreateRepository(ctx context.Context, options *CreateRepositoryOptions) (repository.Repository, error) {
-	repo, _, err := githubClient.client.Repositories.Create(ctx, "", &github.Repository{
+	// Backups are private and should not accept issues or wiki edits, since
+	// these would not be mirrored back to the source
+	// An empty organization creates the repository for the authenticated user
+	org := backupOwner(githubClient.config, githubClient.username)
+
+	repo, _, err := githubClient.client.Repositories.Create(ctx, org, &github.Repository{
 		Name:        &options.Name,
 		Description: &options.Description,
+		Private:     github.Bool(true),
+		HasIssues:   github.Bool(false),
+		HasWiki:     github.Bool(false),
+		HasProjects: github.Bool(false),
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
+	// Disable actions: workflows in the mirrored refs would otherwise run on
+	// every push to the backup repository.
+	_, _, err = githubClient.client.Repositories.EditActionsPermissions(ctx, repo.GetOwner().GetLogin(), repo.GetName(), github.ActionsPermissionsRepository{
+		Enabled: github.Bool(false),
+	})
+	if err != nil {
+		// The next run would adopt the repository and push to it with
+		// actions enabled, so don't leave it behind
+		_, deleteErr := githubClient.client.Repositories.Delete(ctx, repo.GetOwner().GetLogin(), repo.GetName())
+		if deleteErr != nil {
+			return nil, fmt.Errorf("failed disabling actions: %w (deleting the repository also failed: %v)", err, deleteErr)
+		}
+
+		return nil, fmt.Errorf("failed disabling actions: %w", err)
+	}
+
 	return &githubRepository{
 		host: githubClient,
 		repo: repo,
@@ -2,17 +2,60 @@ package vcs
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"gitr-backup/constants"
 	"gitr-backup/vcs/repository"
 	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/google/go-github/v50/github"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 type githubRepository struct {
-	host *GitHub
-	repo *github.Repository
+	host              *GitHub
+	repo              *github.Repository
+	topics            []string
+	topicsInitialized bool
+}
+
+func (repo *githubRepository) getLogger() zerolog.Logger {
+	return log.With().Str("host", repo.host.config.Name).Str("repository", repo.repo.GetName()).Logger()
+}
+
+func (repo *githubRepository) ensureTopics(ctx context.Context) error {
+	logger := repo.getLogger()
+
+	if !repo.topicsInitialized {
+		logger.Debug().Msg("Fetching topics for repository")
+
+		topics, _, err := repo.host.client.Repositories.ListAllTopics(ctx, repo.repo.GetOwner().GetLogin(), repo.repo.GetName())
+		if err != nil {
+			return err
+		}
+
+		repo.topics = topics
+		repo.topicsInitialized = true
+	}
+
+	return nil
+}
+
+func (repo *githubRepository) replaceTopics(ctx context.Context, topics []string) error {
+	if ctx.Value(constants.DRY_RUN).(bool) {
+		return nil
+	}
+
+	// GitHub has no endpoint to add or remove a single topic
+	result, _, err := repo.host.client.Repositories.ReplaceAllTopics(ctx, repo.repo.GetOwner().GetLogin(), repo.repo.GetName(), topics)
+	if err != nil {
+		return err
+	}
+
+	repo.topics = result
+	return nil
 }
 
 func (repo *githubRepository) GetName() string {
@@ -24,11 +67,39 @@ func (repo *githubRepository) GetDescription() string {
 }
 
 func (repo *githubRepository) AddLabel(ctx context.Context, label string) error {
-	return errors.New("not implemented")
+	logger := repo.getLogger()
+
+	err := repo.ensureTopics(ctx)
+	if err != nil {
+		return err
+	}
+
+	if slices.Contains(repo.topics, label) {
+		return nil
+	}
+
+	logger.Info().Msgf("Adding topic %s to repository", label)
+
+	return repo.replaceTopics(ctx, append(slices.Clone(repo.topics), label))
 }
 
 func (repo *githubRepository) RemoveLabel(ctx context.Context, label string) error {
-	return errors.New("not implemented")
+	logger := repo.getLogger()
+
+	err := repo.ensureTopics(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(repo.topics, label) {
+		return nil
+	}
+
+	logger.Info().Msgf("Removing topic %s from repository", label)
+
+	return repo.replaceTopics(ctx, slices.DeleteFunc(slices.Clone(repo.topics), func(topic string) bool {
+		return topic == label
+	}))
 }
 
 func (repo *githubRepository) ListRefs(ctx context.Context) ([]repository.Ref, error) {
@@ -50,6 +121,7 @@ func (repo *githubRepository) ListRefs(ctx context.Context) ([]repository.Ref, e
 			allRefs = append(allRefs, repository.Ref{
 				Name:    ref.GetName(),
 				Sha:     ref.GetCommit().GetSHA(),
+				Peeled:  ref.GetCommit().GetSHA(),
 				RefName: fmt.Sprintf("refs/heads/%s", ref.GetName()),
 			})
 		}
@@ -61,6 +133,9 @@ func (repo *githubRepository) ListRefs(ctx context.Context) ([]repository.Ref, e
 		options.ListOptions.Page = resp.NextPage
 	}
 
+	// The tag listing only has the commits, and the ref listing only has the
+	// objects, which are tag objects for annotated tags
+	peeled := map[string]string{}
 	tagOptions := &github.ListOptions{
 		PerPage: 50,
 	}
@@ -72,10 +147,44 @@ func (repo *githubRepository) ListRefs(ctx context.Context) ([]repository.Ref, e
 		}
 
 		for _, ref := range refs {
+			peeled[fmt.Sprintf("refs/tags/%s", ref.GetName())] = ref.GetCommit().GetSHA()
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		tagOptions.Page = resp.NextPage
+	}
+
+	if len(peeled) == 0 {
+		return allRefs, nil
+	}
+
+	refOptions := &github.ReferenceListOptions{
+		Ref: "tags",
+		ListOptions: github.ListOptions{
+			PerPage: 50,
+		},
+	}
+
+	for {
+		refs, resp, err := repo.host.client.Git.ListMatchingRefs(ctx, repo.repo.GetOwner().GetLogin(), repo.repo.GetName(), refOptions)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range refs {
+			commit, found := peeled[ref.GetRef()]
+			if !found {
+				commit = ref.GetObject().GetSHA()
+			}
+
 			allRefs = append(allRefs, repository.Ref{
-				Name:    ref.GetName(),
-				Sha:     ref.GetCommit().GetSHA(),
-				RefName: fmt.Sprintf("refs/tags/%s", ref.GetName()),
+				Name:    strings.TrimPrefix(ref.GetRef(), "refs/tags/"),
+				Sha:     ref.GetObject().GetSHA(),
+				Peeled:  commit,
+				RefName: ref.GetRef(),
 			})
 		}
 
@@ -83,7 +192,7 @@ func (repo *githubRepository) ListRefs(ctx context.Context) ([]repository.Ref, e
 			break
 		}
 
-		tagOptions.Page = resp.NextPage
+		refOptions.Page = resp.NextPage
 	}
 
 	return allRefs, nil
@@ -108,16 +217,45 @@ func (repo *githubRepository) GetDefaultBranch() string {
 	return repo.repo.GetDefaultBranch()
 }
 
+func (repo *githubRepository) GetWiki(ctx context.Context) (repository.Repository, error) {
+	if !repo.repo.GetHasWiki() {
+		return nil, nil
+	}
+
+	return newWikiRepository(repo.host, repo), nil
+}
+
 func (repo *githubRepository) SetDefaultBranch(ctx context.Context, branch string) error {
-	old := repo.repo.DefaultBranch
-	repo.repo.DefaultBranch = &branch
+	return repo.edit(ctx, &github.Repository{DefaultBranch: &branch})
+}
 
-	r, _, err := repo.host.client.Repositories.Edit(ctx, repo.repo.GetOwner().GetName(), repo.repo.GetName(), repo.repo)
+func (repo *githubRepository) edit(ctx context.Context, changes *github.Repository) error {
+	r, _, err := repo.host.client.Repositories.Edit(ctx, repo.repo.GetOwner().GetLogin(), repo.repo.GetName(), changes)
 	if err != nil {
-		repo.repo.DefaultBranch = old
 		return err
 	}
 
 	repo.repo = r
 	return nil
 }
+
+func (repo *githubRepository) SetDescription(ctx context.Context, description string) error {
+	return repo.edit(ctx, &github.Repository{Description: &description})
+}
+
+func (repo *githubRepository) IsArchived() bool {
+	return repo.repo.GetArchived()
+}
+
+func (repo *githubRepository) SetArchived(ctx context.Context, archived bool) error {
+	return repo.edit(ctx, &github.Repository{Archived: &archived})
+}
+
+func (repo *githubRepository) Rename(ctx context.Context, name string) error {
+	return repo.edit(ctx, &github.Repository{Name: &name})
+}
+
+func (repo *githubRepository) Delete(ctx context.Context) error {
+	_, err := repo.host.client.Repositories.Delete(ctx, repo.repo.GetOwner().GetLogin(), repo.repo.GetName())
+	return err
+}
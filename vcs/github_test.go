@@ -0,0 +1,76 @@
+package vcs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"gitr-backup/config"
+
+	"github.com/google/go-github/v50/github"
+)
+
+func TestIsGitHubCom(t *testing.T) {
+	tests := []struct {
+		baseUrl  string
+		expected bool
+	}{
+		{"", true},
+		{"https://github.com", true},
+		{"https://GitHub.com/", true},
+		{"https://github.company.com", false},
+		{"https://github.com.example.com", false},
+		{"https://git.example.com/github.com", false},
+	}
+
+	for _, test := range tests {
+		public, err := isGitHubCom(test.baseUrl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if public != test.expected {
+			t.Errorf("%q: expected %v, got %v", test.baseUrl, test.expected, public)
+		}
+	}
+}
+
+func TestGitHubCreateRepositoryWithoutActions(t *testing.T) {
+	var deleted atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "POST /api/v3/user/repos":
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(github.Repository{
+				Name:  github.String("repo"),
+				Owner: &github.User{Login: github.String("backup")},
+			})
+		case "PUT /api/v3/repos/backup/repo/actions/permissions":
+			http.Error(w, "{}", http.StatusForbidden)
+		case "DELETE /api/v3/repos/backup/repo":
+			deleted.Store(true)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client, err := github.NewEnterpriseClient(server.URL, server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := &GitHub{config: &config.Host{Name: "github"}, client: client, username: "backup"}
+	_, err = host.CreateRepository(context.Background(), &CreateRepositoryOptions{Name: "repo"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if !deleted.Load() {
+		t.Error("expected the repository to be deleted")
+	}
+}
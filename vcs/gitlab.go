@@ -0,0 +1,206 @@
+package vcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gitr-backup/config"
+	"gitr-backup/vcs/repository"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	gitlab "gitlab.com/gitlab-org/api/client-go"
+)
+
+type GitLab struct {
+	config   *config.Host
+	client   *gitlab.Client
+	username string
+}
+
+func NewGitLabClient(ctx context.Context, config config.Host) (*GitLab, error) {
+	logger := log.With().Str("host", config.Name).Logger()
+
+	logger.Info().Msg("Initializing client")
+
+	client, err := gitlab.NewClient(config.Token, gitlab.WithBaseURL(config.BaseUrl), gitlab.WithHTTPClient(newApiHttpClient(&config)))
+	if err != nil {
+		return nil, err
+	}
+
+	user, _, err := client.Users.CurrentUser(gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	username := user.Username
+	logger.Info().Msgf("Logged in as %s", username)
+
+	return &GitLab{config: &config, client: client, username: username}, nil
+}
+
+func validateGitLabConfig(host *config.Host) error {
+	if host.BaseUrl == "" {
+		host.BaseUrl = "https://gitlab.com"
+	}
+
+	// Self-managed instances may be installed under a subpath, but the
+	// API client needs an absolute url to build requests from
+	parsed, err := url.Parse(host.BaseUrl)
+	if err != nil {
+		return fmt.Errorf("invalid base url for gitlab host: %w", err)
+	}
+
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid base url for gitlab host: %s", host.BaseUrl)
+	}
+
+	if strings.HasSuffix(strings.TrimRight(parsed.Path, "/"), "/api/v4") {
+		return errors.New("the base url for a gitlab host should not include the api path")
+	}
+
+	host.BaseUrl = strings.TrimRight(host.BaseUrl, "/")
+
+	return requireToken(host)
+}
+
+func (gitlabClient *GitLab) GetConfig() *config.Host {
+	return gitlabClient.config
+}
+
+func (gitlabClient *GitLab) GetRepositories(ctx context.Context) ([]repository.Repository, error) {
+	allRepos := []repository.Repository{}
+
+	for _, owner := range ownersOrDefault(gitlabClient.config, gitlabClient.username) {
+		repos, err := gitlabClient.getOwnerRepositories(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		allRepos = append(allRepos, repos...)
+	}
+
+	return allRepos, nil
+}
+
+func (gitlabClient *GitLab) getOwnerRepositories(ctx context.Context, owner string) ([]repository.Repository, error) {
+	logger := log.With().Str("host", gitlabClient.config.Name).Str("owner", owner).Logger()
+
+	var list func(listOptions gitlab.ListOptions) ([]*gitlab.Project, *gitlab.Response, error)
+
+	if owner == gitlabClient.username {
+		list = func(listOptions gitlab.ListOptions) ([]*gitlab.Project, *gitlab.Response, error) {
+			return gitlabClient.client.Projects.ListProjects(&gitlab.ListProjectsOptions{
+				ListOptions: listOptions,
+				Owned:       gitlab.Ptr(true),
+			}, gitlab.WithContext(ctx))
+		}
+	} else {
+		namespace, _, err := gitlabClient.client.Namespaces.GetNamespace(owner, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		if namespace.Kind == "group" {
+			list = func(listOptions gitlab.ListOptions) ([]*gitlab.Project, *gitlab.Response, error) {
+				return gitlabClient.client.Groups.ListGroupProjects(namespace.ID, &gitlab.ListGroupProjectsOptions{
+					ListOptions:      listOptions,
+					IncludeSubGroups: gitlab.Ptr(true),
+				}, gitlab.WithContext(ctx))
+			}
+		} else {
+			list = func(listOptions gitlab.ListOptions) ([]*gitlab.Project, *gitlab.Response, error) {
+				return gitlabClient.client.Projects.ListUserProjects(owner, &gitlab.ListProjectsOptions{
+					ListOptions: listOptions,
+				}, gitlab.WithContext(ctx))
+			}
+		}
+	}
+
+	allRepos := []repository.Repository{}
+	options := gitlab.ListOptions{
+		PerPage: 50,
+	}
+
+	for {
+		projects, resp, err := list(options)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, project := range projects {
+			logger.Debug().Msgf("Found repository: %s (%s)", project.Path, project.Description)
+			allRepos = append(allRepos, &gitlabRepository{
+				host:    gitlabClient,
+				project: project,
+			})
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		options.Page = resp.NextPage
+	}
+
+	return allRepos, nil
+}
+
+func (gitlabClient *GitLab) GetRepositoryByUrl(ctx context.Context, url string) (*repository.Repository, error) {
+	// GitLab supports nested groups, so everything after the base url is the
+	// full path of the project
+	projectPath, err := relativeRepositoryPath(gitlabClient.config.BaseUrl, url)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(projectPath, "/") {
+		return nil, errors.New("invalid repository url for this host")
+	}
+
+	project, resp, err := gitlabClient.client.Projects.GetProject(projectPath, nil, gitlab.WithContext(ctx))
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrRepositoryNotFound, url)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var glRepo repository.Repository = &gitlabRepository{
+		host:    gitlabClient,
+		project: project,
+	}
+
+	return &glRepo, nil
+}
+
+func (gitlabClient *GitLab) CreateRepository(ctx context.Context, options *CreateRepositoryOptions) (repository.Repository, error) {
+	// Disable CI: if a runner matches the pipeline of the backed up
+	// repository, it may run arbitrary code when it's updated.
+	createOptions := &gitlab.CreateProjectOptions{
+		Name:              &options.Name,
+		Description:       &options.Description,
+		Visibility:        gitlab.Ptr(gitlab.PrivateVisibility),
+		BuildsAccessLevel: gitlab.Ptr(gitlab.DisabledAccessControl),
+	}
+
+	if owner := backupOwner(gitlabClient.config, gitlabClient.username); owner != "" {
+		namespace, _, err := gitlabClient.client.Namespaces.GetNamespace(owner, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		createOptions.NamespaceID = &namespace.ID
+	}
+
+	project, _, err := gitlabClient.client.Projects.CreateProject(createOptions, gitlab.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return &gitlabRepository{
+		host:    gitlabClient,
+		project: project,
+	}, nil
+}
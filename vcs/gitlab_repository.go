@@ -0,0 +1,213 @@
+package vcs
+
+import (
+	"context"
+	"fmt"
+	"gitr-backup/constants"
+	"gitr-backup/vcs/repository"
+	"net/url"
+	"slices"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	gitlab "gitlab.com/gitlab-org/api/client-go"
+)
+
+type gitlabRepository struct {
+	host    *GitLab
+	project *gitlab.Project
+}
+
+func (repo *gitlabRepository) getLogger() zerolog.Logger {
+	return log.With().Str("host", repo.host.config.Name).Str("repository", repo.project.Path).Logger()
+}
+
+func (repo *gitlabRepository) editTopics(ctx context.Context, topics []string) error {
+	if ctx.Value(constants.DRY_RUN).(bool) {
+		return nil
+	}
+
+	project, _, err := repo.host.client.Projects.EditProject(repo.project.ID, &gitlab.EditProjectOptions{
+		Topics: &topics,
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	repo.project = project
+	return nil
+}
+
+func (repo *gitlabRepository) GetName() string {
+	return repo.project.Path
+}
+
+func (repo *gitlabRepository) GetDescription() string {
+	return repo.project.Description
+}
+
+func (repo *gitlabRepository) AddLabel(ctx context.Context, label string) error {
+	logger := repo.getLogger()
+
+	if slices.Contains(repo.project.Topics, label) {
+		return nil
+	}
+
+	logger.Info().Msgf("Adding topic %s to repository", label)
+
+	topics := append(slices.Clone(repo.project.Topics), label)
+	return repo.editTopics(ctx, topics)
+}
+
+func (repo *gitlabRepository) RemoveLabel(ctx context.Context, label string) error {
+	logger := repo.getLogger()
+
+	if !slices.Contains(repo.project.Topics, label) {
+		return nil
+	}
+
+	logger.Info().Msgf("Removing topic %s from repository", label)
+
+	topics := slices.DeleteFunc(slices.Clone(repo.project.Topics), func(topic string) bool {
+		return topic == label
+	})
+	return repo.editTopics(ctx, topics)
+}
+
+func (repo *gitlabRepository) ListRefs(ctx context.Context) ([]repository.Ref, error) {
+	allRefs := []repository.Ref{}
+
+	options := &gitlab.ListBranchesOptions{
+		ListOptions: gitlab.ListOptions{
+			PerPage: 50,
+		},
+	}
+
+	for {
+		refs, resp, err := repo.host.client.Branches.ListBranches(repo.project.ID, options, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range refs {
+			allRefs = append(allRefs, repository.Ref{
+				Name:    ref.Name,
+				Sha:     ref.Commit.ID,
+				Peeled:  ref.Commit.ID,
+				RefName: fmt.Sprintf("refs/heads/%s", ref.Name),
+			})
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		options.ListOptions.Page = resp.NextPage
+	}
+
+	tagOptions := &gitlab.ListTagsOptions{
+		ListOptions: gitlab.ListOptions{
+			PerPage: 50,
+		},
+	}
+
+	for {
+		refs, resp, err := repo.host.client.Tags.ListTags(repo.project.ID, tagOptions, gitlab.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ref := range refs {
+			allRefs = append(allRefs, repository.Ref{
+				Name:    ref.Name,
+				Sha:     ref.Target,
+				Peeled:  ref.Commit.ID,
+				RefName: fmt.Sprintf("refs/tags/%s", ref.Name),
+			})
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+
+		tagOptions.ListOptions.Page = resp.NextPage
+	}
+
+	return allRefs, nil
+}
+
+func (repo *gitlabRepository) GetHttpsCloneUrl() (string, error) {
+	parsed, err := url.Parse(repo.project.HTTPURLToRepo)
+	if err != nil {
+		return "", err
+	}
+
+	parsed.User = url.UserPassword(repo.host.username, repo.host.config.Token)
+
+	return parsed.String(), nil
+}
+
+func (repo *gitlabRepository) GetUrl() string {
+	return repo.project.WebURL
+}
+
+func (repo *gitlabRepository) GetDefaultBranch() string {
+	return repo.project.DefaultBranch
+}
+
+func (repo *gitlabRepository) GetWiki(ctx context.Context) (repository.Repository, error) {
+	if repo.project.WikiAccessLevel == gitlab.DisabledAccessControl {
+		return nil, nil
+	}
+
+	return newWikiRepository(repo.host, repo), nil
+}
+
+func (repo *gitlabRepository) edit(ctx context.Context, changes *gitlab.EditProjectOptions) error {
+	project, _, err := repo.host.client.Projects.EditProject(repo.project.ID, changes, gitlab.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	repo.project = project
+	return nil
+}
+
+func (repo *gitlabRepository) SetDefaultBranch(ctx context.Context, branch string) error {
+	return repo.edit(ctx, &gitlab.EditProjectOptions{DefaultBranch: &branch})
+}
+
+func (repo *gitlabRepository) SetDescription(ctx context.Context, description string) error {
+	return repo.edit(ctx, &gitlab.EditProjectOptions{Description: &description})
+}
+
+func (repo *gitlabRepository) IsArchived() bool {
+	return repo.project.Archived
+}
+
+func (repo *gitlabRepository) SetArchived(ctx context.Context, archived bool) error {
+	var project *gitlab.Project
+	var err error
+	if archived {
+		project, _, err = repo.host.client.Projects.ArchiveProject(repo.project.ID, gitlab.WithContext(ctx))
+	} else {
+		project, _, err = repo.host.client.Projects.UnarchiveProject(repo.project.ID, gitlab.WithContext(ctx))
+	}
+
+	if err != nil {
+		return err
+	}
+
+	repo.project = project
+	return nil
+}
+
+func (repo *gitlabRepository) Rename(ctx context.Context, name string) error {
+	// The path is the name used in urls, and by GetName
+	return repo.edit(ctx, &gitlab.EditProjectOptions{Name: &name, Path: &name})
+}
+
+func (repo *gitlabRepository) Delete(ctx context.Context) error {
+	_, err := repo.host.client.Projects.DeleteProject(repo.project.ID, nil, gitlab.WithContext(ctx))
+	return err
+}
@@ -0,0 +1,164 @@
+package vcs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+
+	"gitr-backup/config"
+	"gitr-backup/vcs/repository"
+
+	gitlab "gitlab.com/gitlab-org/api/client-go"
+)
+
+// Serve the pages of the API responses of a GitLab instance installed under
+// /gitlab, keyed by their escaped path
+func newGitLabStub(t *testing.T, owners []string, routes map[string][]any) *GitLab {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages, found := routes[r.URL.EscapedPath()]
+		if r.Method != http.MethodGet || !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		page := 1
+		if value := r.URL.Query().Get("page"); value != "" {
+			page, _ = strconv.Atoi(value)
+		}
+
+		if page < 1 || page > len(pages) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if page < len(pages) {
+			w.Header().Set("X-Next-Page", strconv.Itoa(page+1))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(pages[page-1])
+	}))
+	t.Cleanup(server.Close)
+
+	baseUrl := server.URL + "/gitlab"
+	client, err := gitlab.NewClient("token", gitlab.WithBaseURL(baseUrl), gitlab.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &GitLab{
+		config:   &config.Host{Name: "gitlab", BaseUrl: baseUrl, Token: "token", Owners: owners},
+		client:   client,
+		username: "backup",
+	}
+}
+
+func TestGitLabGetRepositoryByUrl(t *testing.T) {
+	host := newGitLabStub(t, nil, map[string][]any{
+		"/gitlab/api/v4/projects/group%2Fsub%2Frepo": {gitlab.Project{ID: 1, Path: "repo"}},
+	})
+	base := host.config.BaseUrl
+
+	tests := []struct {
+		name     string
+		url      string
+		notFound bool
+		wantErr  bool
+	}{
+		{"subgroup url", base + "/group/sub/repo", false, false},
+		{"clone url", base + "/group/sub/repo.git", false, false},
+		{"trailing slash", base + "/group/sub/repo/", false, false},
+		{"missing repository", base + "/group/sub/other", true, true},
+		{"missing name", base + "/group", false, true},
+		{"outside path prefix", base + "2/group/sub/repo", false, true},
+		{"foreign host", "https://gitlab.example.com/gitlab/group/sub/repo.git", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			repo, err := host.GetRepositoryByUrl(context.Background(), test.url)
+			if errors.Is(err, ErrRepositoryNotFound) != test.notFound {
+				t.Fatalf("unexpected not found error: %v", err)
+			}
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if name := (*repo).GetName(); name != "repo" {
+				t.Errorf("expected repo, got %s", name)
+			}
+		})
+	}
+}
+
+func TestGitLabGetRepositories(t *testing.T) {
+	host := newGitLabStub(t, []string{"backup", "group"}, map[string][]any{
+		"/gitlab/api/v4/projects": {
+			[]gitlab.Project{{ID: 1, Path: "first"}},
+			[]gitlab.Project{{ID: 2, Path: "second"}},
+		},
+		"/gitlab/api/v4/namespaces/group": {gitlab.Namespace{ID: 10, Kind: "group"}},
+		"/gitlab/api/v4/groups/10/projects": {
+			[]gitlab.Project{{ID: 3, Path: "third"}},
+			[]gitlab.Project{{ID: 4, Path: "nested"}},
+		},
+	})
+
+	repos, err := host.GetRepositories(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, repo := range repos {
+		names = append(names, repo.GetName())
+	}
+
+	expected := []string{"first", "second", "third", "nested"}
+	if !slices.Equal(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestGitLabListRefs(t *testing.T) {
+	host := newGitLabStub(t, nil, map[string][]any{
+		"/gitlab/api/v4/projects/1/repository/branches": {
+			[]gitlab.Branch{{Name: "main", Commit: &gitlab.Commit{ID: "c1"}}},
+			[]gitlab.Branch{{Name: "dev", Commit: &gitlab.Commit{ID: "c2"}}},
+		},
+		"/gitlab/api/v4/projects/1/repository/tags": {
+			[]gitlab.Tag{{Name: "lightweight", Target: "c1", Commit: &gitlab.Commit{ID: "c1"}}},
+			[]gitlab.Tag{{Name: "annotated", Target: "t1", Commit: &gitlab.Commit{ID: "c2"}}},
+		},
+	})
+	repo := &gitlabRepository{host: host, project: &gitlab.Project{ID: 1, Path: "repo"}}
+
+	refs, err := repo.ListRefs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []repository.Ref{
+		{Name: "main", Sha: "c1", Peeled: "c1", RefName: "refs/heads/main"},
+		{Name: "dev", Sha: "c2", Peeled: "c2", RefName: "refs/heads/dev"},
+		{Name: "lightweight", Sha: "c1", Peeled: "c1", RefName: "refs/tags/lightweight"},
+		{Name: "annotated", Sha: "t1", Peeled: "c2", RefName: "refs/tags/annotated"},
+	}
+	if !slices.Equal(refs, expected) {
+		t.Errorf("expected %v, got %v", expected, refs)
+	}
+}
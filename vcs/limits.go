@@ -0,0 +1,75 @@
+package vcs
+
+import (
+	"gitr-backup/config"
+	"gitr-backup/metrics"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Limits the number of concurrent requests to the API of a host. A slot is
+// held until the response body is closed.
+type limitedTransport struct {
+	host string
+	base http.RoundTripper
+	sem  *semaphore.Weighted
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (body *limitedBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.release()
+	return err
+}
+
+func (transport *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := transport.sem.Acquire(req.Context(), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	once := sync.Once{}
+	release := func() {
+		once.Do(func() { transport.sem.Release(1) })
+	}
+
+	resp, err := transport.base.RoundTrip(req)
+
+	if err != nil {
+		metrics.ApiRequests.WithLabelValues(transport.host, "error").Inc()
+		metrics.ApiErrors.WithLabelValues(transport.host).Inc()
+	} else {
+		metrics.ApiRequests.WithLabelValues(transport.host, strconv.Itoa(resp.StatusCode)).Inc()
+		if resp.StatusCode >= 500 {
+			metrics.ApiErrors.WithLabelValues(transport.host).Inc()
+		}
+	}
+
+	if err != nil || resp.Body == nil {
+		release()
+		return resp, err
+	}
+
+	resp.Body = &limitedBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// Build the http client used for the API requests to a host, honoring its
+// concurrency limit
+func newApiHttpClient(host *config.Host) *http.Client {
+	return &http.Client{
+		Transport: &limitedTransport{
+			host: host.Name,
+			base: http.DefaultTransport,
+			sem:  semaphore.NewWeighted(int64(host.Concurrency.Api)),
+		},
+	}
+}
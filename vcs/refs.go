@@ -0,0 +1,176 @@
+package vcs
+
+import (
+	"context"
+	"gitr-backup/config"
+	"gitr-backup/vcs/repository"
+	"strings"
+)
+
+// Short name of a ref, as listed by the forge APIs for branches and tags
+func refShortName(refName string) string {
+	if name, found := strings.CutPrefix(refName, "refs/heads/"); found {
+		return name
+	}
+
+	if name, found := strings.CutPrefix(refName, "refs/tags/"); found {
+		return name
+	}
+
+	return refName
+}
+
+func isBranchOrTag(refName string) bool {
+	return strings.HasPrefix(refName, "refs/heads/") || strings.HasPrefix(refName, "refs/tags/")
+}
+
+func filterBranchesAndTags(refs []repository.Ref) []repository.Ref {
+	result := []repository.Ref{}
+	for _, ref := range refs {
+		if isBranchOrTag(ref.RefName) {
+			result = append(result, ref)
+		}
+	}
+
+	return result
+}
+
+// List all the refs advertised by a remote repository, along with the branch
+// HEAD points to, if it can be guessed
+func lsRemoteRefs(ctx context.Context, cloneUrl string) ([]repository.Ref, string, error) {
+	heads, err := lsRemote(ctx, cloneUrl)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Annotated tags are listed twice, the peeled entry has the commit
+	peeled := map[string]string{}
+	for _, head := range heads {
+		if name, found := strings.CutSuffix(head.Name, "^{}"); found {
+			peeled[name] = head.Id.String()
+		}
+	}
+
+	allRefs := []repository.Ref{}
+	headSha := ""
+
+	for _, head := range heads {
+		if head.Name == "HEAD" {
+			headSha = head.Id.String()
+			continue
+		}
+
+		if strings.HasSuffix(head.Name, "^{}") || !strings.HasPrefix(head.Name, "refs/") {
+			continue
+		}
+
+		sha := head.Id.String()
+		commit, found := peeled[head.Name]
+		if !found {
+			commit = sha
+		}
+
+		allRefs = append(allRefs, repository.Ref{Name: refShortName(head.Name), Sha: sha, Peeled: commit, RefName: head.Name})
+	}
+
+	return allRefs, guessHeadBranch(allRefs, headSha), nil
+}
+
+// The protocol doesn't tell which branch HEAD points to, so guess it from the
+// branches pointing to the same commit, preferring the usual names
+func guessHeadBranch(refs []repository.Ref, headSha string) string {
+	if headSha == "" {
+		return ""
+	}
+
+	branch := ""
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref.RefName, "refs/heads/") || ref.Sha != headSha {
+			continue
+		}
+
+		if ref.Name == "main" || ref.Name == "master" || branch == "" {
+			branch = ref.Name
+		}
+	}
+
+	return branch
+}
+
+// Get the default branch of a repository, asking the remote for it if the
+// repository can't tell otherwise
+func GetDefaultBranch(ctx context.Context, repo repository.Repository) (string, error) {
+	if resolver, ok := repo.(repository.DefaultBranchResolver); ok {
+		return resolver.ResolveDefaultBranch(ctx)
+	}
+
+	return repo.GetDefaultBranch(), nil
+}
+
+// Lists the refs of a repository
+type RefLister func(ctx context.Context, repo repository.Repository) ([]repository.Ref, error)
+
+// List the branches and tags through the API of the host
+func listRefsFromApi(ctx context.Context, repo repository.Repository) ([]repository.Ref, error) {
+	return repo.ListRefs(ctx)
+}
+
+// List all the refs with a single ls-remote, instead of paging through the
+// API
+func listRefsFromGit(ctx context.Context, repo repository.Repository) ([]repository.Ref, error) {
+	cloneUrl, err := repo.GetHttpsCloneUrl()
+	if err != nil {
+		return nil, err
+	}
+
+	refs, _, err := lsRemoteRefs(ctx, cloneUrl)
+	return refs, err
+}
+
+// Get the lister of branches and tags configured for a host. Listing over git
+// falls back to the API, e.g. when the git protocol is blocked.
+func GetRefLister(host Vcs) RefLister {
+	if host.GetConfig().RefListing != "git" {
+		return listRefsFromApi
+	}
+
+	return func(ctx context.Context, repo repository.Repository) ([]repository.Ref, error) {
+		refs, err := listRefsFromGit(ctx, repo)
+		if err != nil {
+			logger := GetLogger(host)
+			logger.Warn().Err(err).Str("repository", repo.GetName()).Msg("Failed listing refs over git, falling back to the API")
+			return listRefsFromApi(ctx, repo)
+		}
+
+		return refs, nil
+	}
+}
+
+// List the refs of a repository of a host matching the patterns. The forge
+// APIs only list branches and tags, so other refs are always listed over the
+// git protocol, unless the repository can list them itself.
+func ListMatchingRefs(ctx context.Context, host Vcs, repo repository.Repository, patterns config.RefPatterns) ([]repository.Ref, error) {
+	var refs []repository.Ref
+	var err error
+
+	if lister, ok := repo.(repository.FullRefLister); ok {
+		refs, err = lister.ListAllRefs(ctx)
+	} else if !patterns.OnlyBranchesAndTags() {
+		refs, err = listRefsFromGit(ctx, repo)
+	} else {
+		refs, err = GetRefLister(host)(ctx, repo)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := []repository.Ref{}
+	for _, ref := range refs {
+		if patterns.Match(ref.RefName) {
+			result = append(result, ref)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,35 @@
+package vcs
+
+import (
+	"testing"
+
+	"gitr-backup/vcs/repository"
+)
+
+func TestGuessHeadBranch(t *testing.T) {
+	branch := func(name, sha string) repository.Ref {
+		return repository.Ref{Name: name, Sha: sha, Peeled: sha, RefName: "refs/heads/" + name}
+	}
+
+	tests := []struct {
+		name     string
+		refs     []repository.Ref
+		headSha  string
+		expected string
+	}{
+		{"no head", []repository.Ref{branch("main", "a")}, "", ""},
+		{"single match", []repository.Ref{branch("dev", "b"), branch("trunk", "a")}, "a", "trunk"},
+		{"prefers main", []repository.Ref{branch("dev", "a"), branch("main", "a"), branch("topic", "a")}, "a", "main"},
+		{"prefers master", []repository.Ref{branch("master", "a"), branch("dev", "a")}, "a", "master"},
+		{"ignores tags", []repository.Ref{{Name: "v1", Sha: "a", Peeled: "a", RefName: "refs/tags/v1"}}, "a", ""},
+		{"no match", []repository.Ref{branch("main", "b")}, "a", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := guessHeadBranch(test.refs, test.headSha); actual != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
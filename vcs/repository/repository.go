@@ -5,8 +5,11 @@ import (
 )
 
 type Ref struct {
-	Name    string `diff:"name, identifier"`
-	Sha     string `diff:"sha"`
+	Name string `diff:"name, identifier"`
+	// Object the ref points to, which is a tag object for annotated tags
+	Sha string `diff:"sha"`
+	// Commit the ref resolves to, the same as Sha except for annotated tags
+	Peeled  string `diff:"peeled"`
 	RefName string `diff:"-"`
 }
 
@@ -20,4 +23,46 @@ type Repository interface {
 	GetUrl() string
 	GetDefaultBranch() string
 	SetDefaultBranch(ctx context.Context, branch string) error
+	SetDescription(ctx context.Context, description string) error
+}
+
+// FullRefLister is implemented by repositories which can list all their refs,
+// not only branches and tags, without going through the git protocol.
+type FullRefLister interface {
+	ListAllRefs(ctx context.Context) ([]Ref, error)
+}
+
+// DefaultBranchResolver is implemented by repositories whose default branch
+// is only known by asking the remote over the git protocol.
+type DefaultBranchResolver interface {
+	ResolveDefaultBranch(ctx context.Context) (string, error)
+}
+
+// WikiHolder is implemented by repositories which can have a wiki, stored as a
+// separate git repository.
+type WikiHolder interface {
+	// Get the wiki of the repository, or nil if it is disabled
+	GetWiki(ctx context.Context) (Repository, error)
+}
+
+// Archivable is implemented by repositories which can be made read-only.
+type Archivable interface {
+	IsArchived() bool
+	SetArchived(ctx context.Context, archived bool) error
+}
+
+// Renamer is implemented by repositories which can be renamed.
+type Renamer interface {
+	Rename(ctx context.Context, name string) error
+}
+
+// Deleter is implemented by repositories which can be deleted.
+type Deleter interface {
+	Delete(ctx context.Context) error
+}
+
+// Archiver is implemented by repositories that store snapshots of a local
+// mirror of the source instead of receiving pushes.
+type Archiver interface {
+	Archive(ctx context.Context, localPath string, changedRefs, deletedRefs []Ref) error
 }
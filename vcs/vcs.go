@@ -2,9 +2,12 @@ package vcs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"gitr-backup/config"
 	"gitr-backup/vcs/repository"
+	"net/url"
+	"strings"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -22,6 +25,48 @@ type Vcs interface {
 	CreateRepository(ctx context.Context, options *CreateRepositoryOptions) (repository.Repository, error)
 }
 
+// Factory creates the client for a configured host
+type Factory func(ctx context.Context, config config.Host) (Vcs, error)
+
+var factories = map[string]Factory{}
+
+// Register a provider for a host type. The validator is called when loading
+// the configuration for hosts of this type, and may be nil.
+func Register(hostType string, factory Factory, validator config.Validator) {
+	if _, found := factories[hostType]; found {
+		panic(fmt.Sprintf("provider %s registered twice", hostType))
+	}
+
+	factories[hostType] = factory
+	config.RegisterHostType(hostType, validator)
+}
+
+func init() {
+	Register("github", func(ctx context.Context, config config.Host) (Vcs, error) {
+		return NewGitHubClient(ctx, config)
+	}, validateGitHubConfig)
+
+	Register("gitea", func(ctx context.Context, config config.Host) (Vcs, error) {
+		return NewGiteaClient(ctx, config)
+	}, validateGiteaConfig)
+
+	Register("gitlab", func(ctx context.Context, config config.Host) (Vcs, error) {
+		return NewGitLabClient(ctx, config)
+	}, validateGitLabConfig)
+
+	Register("git", func(ctx context.Context, config config.Host) (Vcs, error) {
+		return NewGitClient(ctx, config)
+	}, validateGitConfig)
+
+	Register("filesystem", func(ctx context.Context, config config.Host) (Vcs, error) {
+		return NewFilesystemClient(ctx, config)
+	}, validateFilesystemConfig)
+
+	Register("bundle", func(ctx context.Context, config config.Host) (Vcs, error) {
+		return NewBundleClient(ctx, config)
+	}, validateBundleConfig)
+}
+
 func LoadClients(ctx context.Context, config *config.Config) ([]Vcs, error) {
 	result := []Vcs{}
 
@@ -29,16 +74,14 @@ func LoadClients(ctx context.Context, config *config.Config) ([]Vcs, error) {
 		var err error
 		var client Vcs
 
-		if host.Type == "gitea" {
-			client, err = NewGiteaClient(ctx, host)
-		} else if host.Type == "github" {
-			client, err = NewGitHubClient(ctx, host)
+		if factory, found := factories[host.Type]; found {
+			client, err = factory(ctx, host)
 		} else {
 			err = fmt.Errorf("unsupported host type: %s", host.Type)
 		}
 
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("failed initializing host %s: %w", host.Name, err)
 		}
 
 		result = append(result, client)
@@ -47,6 +90,74 @@ func LoadClients(ctx context.Context, config *config.Config) ([]Vcs, error) {
 	return result, nil
 }
 
+// Returned by GetRepositoryByUrl when the repository doesn't exist (anymore)
+var ErrRepositoryNotFound = errors.New("repository not found")
+
+func requireToken(host *config.Host) error {
+	if host.Token == "" {
+		return errors.New("missing token for authentication")
+	}
+
+	return nil
+}
+
+// Get the url prefixes the repositories of a host live under. This is the
+// base url, unless the host serves repositories from arbitrary urls.
+func GetUrlPrefixes(host Vcs) []string {
+	if prefixer, ok := host.(interface{ GetUrlPrefixes() []string }); ok {
+		return prefixer.GetUrlPrefixes()
+	}
+
+	return []string{host.GetConfig().BaseUrl}
+}
+
+// Get the owners whose repositories should be listed on a host. This defaults
+// to the authenticated user.
+func ownersOrDefault(config *config.Host, username string) []string {
+	if len(config.Owners) == 0 {
+		return []string{username}
+	}
+
+	return config.Owners
+}
+
+// Get the owner new backup repositories should be created under, or an empty
+// string if they should be created for the authenticated user.
+func backupOwner(config *config.Host, username string) string {
+	if len(config.Owners) == 0 || config.Owners[0] == username {
+		return ""
+	}
+
+	return config.Owners[0]
+}
+
 func GetLogger(vcs Vcs) zerolog.Logger {
 	return log.With().Str("host", vcs.GetConfig().Name).Logger()
 }
+
+// Get the path of a repository url relative to the base url of a host. This
+// accounts for hosts installed under a subpath, and strips the .git suffix of
+// clone urls.
+func relativeRepositoryPath(baseUrl, repositoryUrl string) (string, error) {
+	base, err := url.Parse(baseUrl)
+	if err != nil {
+		return "", err
+	}
+
+	parsed, err := url.Parse(repositoryUrl)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.EqualFold(base.Host, parsed.Host) {
+		return "", errors.New("invalid repository url for this host")
+	}
+
+	basePath := strings.TrimRight(base.Path, "/") + "/"
+	if !strings.HasPrefix(parsed.Path, basePath) {
+		return "", errors.New("invalid repository url for this host")
+	}
+
+	path := strings.Trim(strings.TrimPrefix(parsed.Path, basePath), "/")
+	return strings.TrimSuffix(path, ".git"), nil
+}
@@ -0,0 +1,46 @@
+package vcs
+
+import "testing"
+
+func TestRelativeRepositoryPath(t *testing.T) {
+	tests := []struct {
+		name          string
+		baseUrl       string
+		repositoryUrl string
+		expected      string
+		wantErr       bool
+	}{
+		{"root", "https://git.example.com", "https://git.example.com/owner/repo", "owner/repo", false},
+		{"path prefix", "https://example.com/gitea", "https://example.com/gitea/owner/repo", "owner/repo", false},
+		{"outside path prefix", "https://example.com/gitea", "https://example.com/other/owner/repo", "", true},
+		{"sibling path prefix", "https://example.com/gitea", "https://example.com/gitea2/owner/repo", "", true},
+		{"trailing slash in base", "https://example.com/gitea/", "https://example.com/gitea/owner/repo", "owner/repo", false},
+		{"trailing slash in url", "https://git.example.com", "https://git.example.com/owner/repo/", "owner/repo", false},
+		{"git suffix", "https://git.example.com", "https://git.example.com/owner/repo.git", "owner/repo", false},
+		{"host case", "https://git.example.com", "https://GIT.example.com/owner/repo", "owner/repo", false},
+		{"foreign host", "https://git.example.com", "https://git.example.org/owner/repo", "", true},
+		{"missing name", "https://git.example.com", "https://git.example.com/owner", "owner", false},
+		{"missing owner and name", "https://git.example.com", "https://git.example.com/", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, err := relativeRepositoryPath(test.baseUrl, test.repositoryUrl)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %q", path)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if path != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, path)
+			}
+		})
+	}
+}
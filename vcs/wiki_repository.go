@@ -0,0 +1,148 @@
+package vcs
+
+import (
+	"context"
+	"gitr-backup/vcs/repository"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// Forges serve the wiki of a repository from the same url, with this suffix
+const wikiUrlSuffix = ".wiki"
+
+// Wikis are backed up under the name of their repository, with this suffix,
+// on hosts which don't keep wikis
+const wikiNameSuffix = "-wiki"
+
+// Get the url of the wiki of a repository
+func WikiUrl(repositoryUrl string) string {
+	return strings.TrimSuffix(strings.TrimRight(repositoryUrl, "/"), ".git") + wikiUrlSuffix
+}
+
+// Get the url of the repository a wiki belongs to, if the url is the one of a
+// wiki
+func WikiParentUrl(wikiUrl string) (string, bool) {
+	return strings.CutSuffix(wikiUrl, wikiUrlSuffix)
+}
+
+// Check whether a repository is the wiki of another one
+func IsWiki(repo repository.Repository) bool {
+	_, ok := repo.(*wikiRepository)
+	return ok
+}
+
+// Get the name of the backup of the wiki of a repository
+func WikiName(repositoryName string) string {
+	return repositoryName + wikiNameSuffix
+}
+
+// Get the wiki of a repository, or nil if it has none
+func GetWiki(ctx context.Context, repo repository.Repository) (repository.Repository, error) {
+	if holder, ok := repo.(repository.WikiHolder); ok {
+		return holder.GetWiki(ctx)
+	}
+
+	return nil, nil
+}
+
+// Check whether the repositories of a host have a wiki which backups can be
+// pushed to. Other hosts get a separate repository for each wiki.
+func HostsWikis(host Vcs) bool {
+	if wikiHost, ok := host.(interface{ HostsWikis() bool }); ok {
+		return wikiHost.HostsWikis()
+	}
+
+	return false
+}
+
+// Wiki of a forge repository, only reachable over git
+type wikiRepository struct {
+	host   Vcs
+	parent repository.Repository
+}
+
+func newWikiRepository(host Vcs, parent repository.Repository) *wikiRepository {
+	return &wikiRepository{host: host, parent: parent}
+}
+
+func (repo *wikiRepository) getLogger() zerolog.Logger {
+	logger := GetLogger(repo.host)
+	return logger.With().Str("repository", repo.GetName()).Logger()
+}
+
+func (repo *wikiRepository) GetName() string {
+	return WikiName(repo.parent.GetName())
+}
+
+func (repo *wikiRepository) GetDescription() string {
+	return repo.parent.GetDescription()
+}
+
+func (repo *wikiRepository) AddLabel(ctx context.Context, label string) error {
+	// Wikis have no labels of their own
+	return nil
+}
+
+func (repo *wikiRepository) RemoveLabel(ctx context.Context, label string) error {
+	return nil
+}
+
+func (repo *wikiRepository) ListAllRefs(ctx context.Context) ([]repository.Ref, error) {
+	cloneUrl, err := repo.GetHttpsCloneUrl()
+	if err != nil {
+		return nil, err
+	}
+
+	allRefs, _, err := lsRemoteRefs(ctx, cloneUrl)
+	return allRefs, err
+}
+
+func (repo *wikiRepository) ListRefs(ctx context.Context) ([]repository.Ref, error) {
+	allRefs, err := repo.ListAllRefs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterBranchesAndTags(allRefs), nil
+}
+
+func (repo *wikiRepository) GetHttpsCloneUrl() (string, error) {
+	cloneUrl, err := repo.parent.GetHttpsCloneUrl()
+	if err != nil {
+		return "", err
+	}
+
+	return WikiUrl(cloneUrl) + ".git", nil
+}
+
+func (repo *wikiRepository) GetUrl() string {
+	return WikiUrl(repo.parent.GetUrl())
+}
+
+// Only the remote knows the default branch of a wiki
+func (repo *wikiRepository) GetDefaultBranch() string {
+	return ""
+}
+
+func (repo *wikiRepository) ResolveDefaultBranch(ctx context.Context) (string, error) {
+	cloneUrl, err := repo.GetHttpsCloneUrl()
+	if err != nil {
+		return "", err
+	}
+
+	_, headBranch, err := lsRemoteRefs(ctx, cloneUrl)
+	return headBranch, err
+}
+
+func (repo *wikiRepository) SetDefaultBranch(ctx context.Context, branch string) error {
+	// The forge picks the branch of the wiki
+	logger := repo.getLogger()
+	logger.Debug().Str("branch", branch).Msg("Cannot set the default branch of a wiki")
+
+	return nil
+}
+
+func (repo *wikiRepository) SetDescription(ctx context.Context, description string) error {
+	return nil
+}